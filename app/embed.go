@@ -0,0 +1,10 @@
+package app
+
+import (
+    "embed"
+)
+
+// Templates holds the page and mail templates compiled into the binary.
+//
+//go:embed templates
+var Templates embed.FS
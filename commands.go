@@ -0,0 +1,266 @@
+package main
+
+import (
+    "crypto/rand"
+    "database/sql"
+    _ "embed"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "time"
+
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/backup"
+    "zmtwc/sk/internal/server"
+)
+
+const usage = `Usage: sk [flags] [command], run sk -h for the flags
+
+Commands:
+  sk [serve]                    start the server
+  sk migrate                    create the schema or bring it up to date
+  sk user create <name> [email] create a user with a generated password
+  sk user disable <name>        block a user from logging in and end their sessions
+  sk user enable <name>         allow a disabled user to log in again
+  sk user reset-password <name> set a new generated password and end their sessions
+  sk user promote <name>        make a user an administrator
+  sk story list                 list all stories including drafts
+  sk story delete <id>          delete a story, telling its webhooks
+  sk sessions purge [all]       delete expired sessions, or all of them
+  sk seed                       fill an empty database with example data
+  sk backup [file]              write a consistent copy of the database, into BACKUP_DIR by default
+  sk restore <file>             replace the database with a backup, the server may keep running
+  sk dump [file]                write all data as portable JSON, to stdout by default
+  sk load <file>                replace all data with a JSON dump, the schema must exist already`
+
+// schema creates new databases, it is compiled in so migrate works from any directory.
+//
+//go:embed init.sql
+var schema string
+
+// runCommand runs one of the maintenance subcommands against the database.
+func runCommand(name string, args []string) error {
+    db, err := server.OpenDB()
+    if err != nil {
+        return err
+    }
+
+    switch name {
+    case "migrate":
+        if len(args) == 0 {
+            return migrateCommand(db)
+        }
+    case "user":
+        if len(args) > 1 {
+            return userCommand(db, args[0], args[1:])
+        }
+    case "story":
+        if len(args) > 0 {
+            return storyCommand(db, args[0], args[1:])
+        }
+    case "sessions":
+        if len(args) > 0 && args[0] == "purge" && len(args) <= 2 {
+            deleted, err := auth.PurgeSessions(db, len(args) == 2 && args[1] == "all")
+            if err != nil {
+                return err
+            }
+            log.Printf("Deleted %d sessions", deleted)
+            return nil
+        }
+    case "seed":
+        if len(args) == 0 {
+            return seedCommand(db)
+        }
+    case "backup", "restore", "dump", "load":
+        return backupCommand(db, name, args)
+    }
+    return errors.New(usage)
+}
+
+func generatePassword() (string, error) {
+    bytes := make([]byte, 12)
+    _, err := rand.Read(bytes)
+    if err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func migrateCommand(db *sql.DB) error {
+    version, err := server.Migrate(db, schema)
+    if err != nil {
+        return err
+    }
+    log.Printf("Database schema is at version %d", version)
+    return nil
+}
+
+func userCommand(db *sql.DB, action string, args []string) error {
+    username := args[0]
+    if action == "create" && len(args) <= 2 {
+        email := ""
+        if len(args) == 2 {
+            email = args[1]
+        }
+        password, err := generatePassword()
+        if err != nil {
+            return err
+        }
+        _, err = server.CreateUser(db, username, password, email)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Created %s with password %s\n", username, password)
+        return nil
+    }
+    if len(args) != 1 {
+        return errors.New(usage)
+    }
+    switch action {
+    case "disable", "enable", "promote", "reset-password":
+    default:
+        return errors.New(usage)
+    }
+
+    userID, err := server.GetUserIDByName(db, username)
+    if err == sql.ErrNoRows {
+        return fmt.Errorf("Cannot find user %s", username)
+    }
+    if err != nil {
+        return err
+    }
+    switch action {
+    case "disable":
+        err = server.SetUserDisabled(db, userID, true)
+    case "enable":
+        err = server.SetUserDisabled(db, userID, false)
+    case "promote":
+        err = server.SetUserAdmin(db, userID, true)
+    case "reset-password":
+        password, err := generatePassword()
+        if err != nil {
+            return err
+        }
+        err = auth.SetPassword(db, userID, password)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("New password of %s is %s\n", username, password)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    log.Printf("User %s: %s done", username, action)
+    return nil
+}
+
+func storyCommand(db *sql.DB, action string, args []string) error {
+    switch {
+    case action == "list" && len(args) == 0:
+        stories, err := server.ListStories(db)
+        if err != nil {
+            return err
+        }
+        for _, story := range stories {
+            title := story.Title
+            if story.Status == 0 {
+                title = "(draft) " + title
+            }
+            fmt.Printf("%d\t%s\t%s\t%s\t%d tasks\n", story.ID, story.StartTime, story.CreatorName, title, story.TaskCount)
+        }
+        return nil
+    case action == "delete" && len(args) == 1:
+        storyID, err := strconv.ParseInt(args[0], 10, 64)
+        if err != nil {
+            return fmt.Errorf("Cannot parse value %s as integer: %s", args[0], err)
+        }
+        err = server.DeleteStory(db, storyID)
+        server.StopWebhooks()
+        if err != nil {
+            return fmt.Errorf("Error deleting story: %s", err)
+        }
+        log.Printf("Deleted story %d", storyID)
+        return nil
+    }
+    return errors.New(usage)
+}
+
+// seedCommand creates an organizer, a volunteer and a published story for
+// trying the application out. It refuses to touch a database that has users.
+func seedCommand(db *sql.DB) error {
+    var users int64
+    err := db.QueryRow("SELECT COUNT(*) FROM user").Scan(&users)
+    if err != nil {
+        return err
+    }
+    if users > 0 {
+        return fmt.Errorf("Database already has users, seed only fills empty databases")
+    }
+    organizerID, volunteerID, err := server.Seed(db, "password")
+    if err != nil {
+        return err
+    }
+    log.Printf("Created organizer (%d) and volunteer (%d) with password \"password\"", organizerID, volunteerID)
+    return nil
+}
+
+func backupCommand(db *sql.DB, name string, args []string) error {
+    switch {
+    case name == "backup" && len(args) <= 1:
+        path := filepath.Join(server.BackupDir(), backup.FileName(time.Now()))
+        if len(args) == 1 {
+            path = args[0]
+        }
+        err := backup.Backup(db, path)
+        if err != nil {
+            return err
+        }
+        log.Printf("Wrote backup %s", path)
+    case name == "restore" && len(args) == 1:
+        err := backup.Verify(args[0])
+        if err != nil {
+            return err
+        }
+        safety := filepath.Join(server.BackupDir(), "before-restore-" + time.Now().Format("20060102-150405") + ".db")
+        err = backup.Backup(db, safety)
+        if err != nil {
+            return fmt.Errorf("Cannot back up the current database first: %s", err)
+        }
+        err = backup.Restore(db, args[0])
+        if err != nil {
+            return err
+        }
+        log.Printf("Restored %s, the previous data is in %s", args[0], safety)
+    case name == "dump" && len(args) <= 1:
+        var w io.Writer = os.Stdout
+        if len(args) == 1 {
+            file, err := os.OpenFile(args[0], os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+            if err != nil {
+                return err
+            }
+            defer file.Close()
+            w = file
+        }
+        return backup.WriteDump(db, w)
+    case name == "load" && len(args) == 1:
+        file, err := os.Open(args[0])
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        err = backup.LoadDump(db, file)
+        if err != nil {
+            return err
+        }
+        log.Printf("Loaded %s", args[0])
+    default:
+        return errors.New(usage)
+    }
+    return nil
+}
@@ -1,54 +1,225 @@
-DROP TABLE IF EXISTS user;
-CREATE TABLE IF NOT EXISTS user (
-    id INTEGER NOT NULL,
-    username TEXT NOT NULL UNIQUE,
-    password TEXT NOT NULL,
-    PRIMARY KEY (id)
-);
-
-DROP TABLE IF EXISTS access_token;
-CREATE TABLE IF NOT EXISTS access_token (
-    user_id INTEGER NOT NULL,
-    token TEXT NOT NULL,
-    valid_to INTEGER NOT NULL,
-    PRIMARY KEY (user_id, token),
-    FOREIGN KEY (user_id)
-      REFERENCES user (id)
-);
-
-DROP TABLE IF EXISTS story;
-CREATE TABLE IF NOT EXISTS story (
-    id INTEGER NOT NULL,
-    title TEXT,
-    description TEXT,
-    start_time INTEGER,
-   	creator_id INTEGER NOT NULL,
-    status INTEGER,
-    PRIMARY KEY (id),
-    FOREIGN KEY (creator_id)
-      REFERENCES user (id)
-);
-
-DROP TABLE IF EXISTS task;
-CREATE TABLE IF NOT EXISTS task (
-    id INTEGER NOT NULL,
-    story_id INTEGER NOT NULL,
-    name TEXT NOT NULL,
-    description TEXT,
-    slots INTEGER DEFAULT 1,
-    PRIMARY KEY (id),
-    FOREIGN KEY (story_id)
-      REFERENCES story (id)
-);
-
-DROP TABLE IF EXISTS assignment;
-CREATE TABLE IF NOT EXISTS assignment (
-    id INTEGER NOT NULL,
-    task_id INTEGER NOT NULL,
-    assignee_id INTEGER,
-    PRIMARY KEY (id)
-    FOREIGN KEY (task_id)
-      REFERENCES task (id),
-    FOREIGN KEY (assignee_id)
-      REFERENCES user (id)
-);
+DROP TABLE IF EXISTS user;
+CREATE TABLE IF NOT EXISTS user (
+    id INTEGER NOT NULL,
+    username TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    email TEXT,
+    calendar_token TEXT UNIQUE,
+    is_admin INTEGER DEFAULT 0,
+    disabled INTEGER DEFAULT 0,
+    PRIMARY KEY (id)
+);
+
+DROP TABLE IF EXISTS access_token;
+CREATE TABLE IF NOT EXISTS access_token (
+    user_id INTEGER NOT NULL,
+    token TEXT NOT NULL,
+    valid_to INTEGER NOT NULL,
+    PRIMARY KEY (user_id, token),
+    FOREIGN KEY (user_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS story;
+CREATE TABLE IF NOT EXISTS story (
+    id INTEGER NOT NULL,
+    title TEXT,
+    description TEXT,
+    start_time INTEGER,
+    end_time INTEGER,
+   	creator_id INTEGER NOT NULL,
+    status INTEGER,
+    visibility INTEGER DEFAULT 0,
+    max_tasks_per_user INTEGER DEFAULT 0,
+    max_no_shows INTEGER DEFAULT 0,
+    PRIMARY KEY (id),
+    FOREIGN KEY (creator_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS story_organizer;
+CREATE TABLE IF NOT EXISTS story_organizer (
+    story_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    PRIMARY KEY (story_id, user_id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id),
+    FOREIGN KEY (user_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS story_invitee;
+CREATE TABLE IF NOT EXISTS story_invitee (
+    story_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    PRIMARY KEY (story_id, user_id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id),
+    FOREIGN KEY (user_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS story_invite_link;
+CREATE TABLE IF NOT EXISTS story_invite_link (
+    id INTEGER NOT NULL,
+    story_id INTEGER NOT NULL,
+    token TEXT NOT NULL UNIQUE,
+    revoked INTEGER DEFAULT 0,
+    PRIMARY KEY (id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id)
+);
+
+DROP TABLE IF EXISTS task;
+CREATE TABLE IF NOT EXISTS task (
+    id INTEGER NOT NULL,
+    story_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT,
+    slots INTEGER DEFAULT 1,
+    exclusive_group TEXT,
+    section TEXT,
+    position INTEGER DEFAULT 0,
+    start_time INTEGER,
+    end_time INTEGER,
+    locked INTEGER DEFAULT 0,
+    PRIMARY KEY (id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id)
+);
+
+DROP TABLE IF EXISTS assignment;
+CREATE TABLE IF NOT EXISTS assignment (
+    id INTEGER NOT NULL,
+    task_id INTEGER NOT NULL,
+    assignee_id INTEGER,
+    joined_at INTEGER,
+    PRIMARY KEY (id),
+    UNIQUE (task_id, assignee_id),
+    FOREIGN KEY (task_id)
+      REFERENCES task (id),
+    FOREIGN KEY (assignee_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS attendance_record;
+CREATE TABLE IF NOT EXISTS attendance_record (
+    task_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    story_id INTEGER NOT NULL,
+    attendance INTEGER NOT NULL,
+    recorded_at INTEGER NOT NULL,
+    PRIMARY KEY (task_id, user_id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id),
+    FOREIGN KEY (user_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS assignment_log;
+CREATE TABLE IF NOT EXISTS assignment_log (
+    id INTEGER NOT NULL,
+    task_id INTEGER NOT NULL,
+    assignee_id INTEGER NOT NULL,
+    actor_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (task_id)
+      REFERENCES task (id),
+    FOREIGN KEY (assignee_id)
+      REFERENCES user (id),
+    FOREIGN KEY (actor_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS comment;
+CREATE TABLE IF NOT EXISTS comment (
+    id INTEGER NOT NULL,
+    story_id INTEGER NOT NULL,
+    task_id INTEGER,
+    author_id INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    edited_at INTEGER,
+    PRIMARY KEY (id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id),
+    FOREIGN KEY (task_id)
+      REFERENCES task (id),
+    FOREIGN KEY (author_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS notification_setting;
+CREATE TABLE IF NOT EXISTS notification_setting (
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    enabled INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (user_id, kind),
+    FOREIGN KEY (user_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS story_reminder;
+CREATE TABLE IF NOT EXISTS story_reminder (
+    story_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    lead INTEGER NOT NULL,
+    start_time INTEGER NOT NULL,
+    sent_at INTEGER NOT NULL,
+    PRIMARY KEY (story_id, user_id, lead, start_time),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id),
+    FOREIGN KEY (user_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS webhook;
+CREATE TABLE IF NOT EXISTS webhook (
+    id INTEGER NOT NULL,
+    story_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    creator_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id),
+    FOREIGN KEY (creator_id)
+      REFERENCES user (id)
+);
+
+DROP TABLE IF EXISTS webhook_delivery;
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id INTEGER NOT NULL,
+    webhook_id INTEGER NOT NULL,
+    delivery_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER,
+    error TEXT,
+    payload TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (webhook_id)
+      REFERENCES webhook (id)
+);
+
+DROP TABLE IF EXISTS notification;
+CREATE TABLE IF NOT EXISTS notification (
+    id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    message TEXT NOT NULL,
+    story_id INTEGER,
+    created_at INTEGER NOT NULL,
+    read_at INTEGER,
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id)
+      REFERENCES user (id),
+    FOREIGN KEY (story_id)
+      REFERENCES story (id)
+);
+
+PRAGMA user_version = 18;
@@ -0,0 +1,100 @@
+package apperror
+
+import (
+    "errors"
+    "runtime/debug"
+)
+
+type Kind int
+
+const (
+    KindInternal Kind = iota
+    KindNotFound
+    KindForbidden
+    KindUnauthorized
+    KindValidation
+    KindConflict
+)
+
+const internalMessage = "Something went wrong on our side, please try again later"
+
+// Error is an error with a message that is safe to show to the user. The
+// cause and, for internal errors, the stack are only meant for the server log.
+type Error struct {
+    Kind Kind
+    Message string
+    Err error
+    Stack []byte
+}
+
+func (e *Error) Error() string {
+    if e.Err == nil {
+        return e.Message
+    }
+    return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+    return e.Err
+}
+
+// Status returns the HTTP status code matching the kind of error.
+func (e *Error) Status() int {
+    switch e.Kind {
+    case KindNotFound:
+        return 404
+    case KindForbidden:
+        return 403
+    case KindUnauthorized:
+        return 401
+    case KindValidation:
+        return 400
+    case KindConflict:
+        return 409
+    }
+    return 500
+}
+
+// PublicMessage returns the message for the user, internal errors never
+// reveal what went wrong.
+func (e *Error) PublicMessage() string {
+    if e.Kind == KindInternal {
+        return internalMessage
+    }
+    return e.Message
+}
+
+// Internal wraps an unexpected error, message says what was being done,
+// e.g. "Error getting story", and only ends up in the log.
+func Internal(message string, err error) *Error {
+    return &Error{ Kind: KindInternal, Message: message, Err: err, Stack: debug.Stack() }
+}
+
+func NotFound(message string) *Error {
+    return &Error{ Kind: KindNotFound, Message: message }
+}
+
+func Forbidden(message string) *Error {
+    return &Error{ Kind: KindForbidden, Message: message }
+}
+
+func Unauthorized(message string) *Error {
+    return &Error{ Kind: KindUnauthorized, Message: message }
+}
+
+func Validation(message string) *Error {
+    return &Error{ Kind: KindValidation, Message: message }
+}
+
+func Conflict(message string) *Error {
+    return &Error{ Kind: KindConflict, Message: message }
+}
+
+// From returns err as an application error, errors of any other type are internal.
+func From(err error) *Error {
+    var appErr *Error
+    if errors.As(err, &appErr) {
+        return appErr
+    }
+    return Internal("Unexpected error", err)
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    "modernc.org/sqlite"
+)
+
+const filePrefix = "sk-"
+const fileSuffix = ".db"
+
+// FileName names automatic backups so that sorting by name sorts by age.
+func FileName(t time.Time) string {
+    return filePrefix + t.Format("20060102-150405") + fileSuffix
+}
+
+// Backup writes a consistent copy of the database to path using VACUUM INTO,
+// which is safe while the server keeps writing. The file must not exist yet.
+func Backup(db *sql.DB, path string) error {
+    _, err := os.Stat(path)
+    if err == nil {
+        return fmt.Errorf("%s already exists", path)
+    }
+    err = os.MkdirAll(filepath.Dir(path), 0755)
+    if err != nil {
+        return err
+    }
+    _, err = db.Exec("VACUUM INTO $1", path)
+    return err
+}
+
+// Verify checks that the file is an intact SQLite database holding our schema.
+func Verify(path string) error {
+    _, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+    db, err := sql.Open("sqlite", "file:" + path + "?mode=ro")
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+
+    var result string
+    err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+    if err != nil {
+        return fmt.Errorf("%s is not a database: %s", path, err)
+    }
+    if result != "ok" {
+        return fmt.Errorf("%s is damaged: %s", path, result)
+    }
+    var tables int64
+    err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('user', 'story', 'task')").Scan(&tables)
+    if err != nil {
+        return err
+    }
+    if tables != 3 {
+        return fmt.Errorf("%s is not a backup of this application", path)
+    }
+    return nil
+}
+
+// Restore replaces the content of the database with the backup through the
+// SQLite online backup API, so connections that stay open see the restored data.
+func Restore(db *sql.DB, path string) error {
+    err := Verify(path)
+    if err != nil {
+        return err
+    }
+    conn, err := db.Conn(context.Background())
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    return conn.Raw(func(driverConn any) error {
+        if wrapped, ok := driverConn.(interface{ Unwrap() driver.Conn }); ok {
+            driverConn = wrapped.Unwrap()
+        }
+        restorer, ok := driverConn.(interface{ NewRestore(string) (*sqlite.Backup, error) })
+        if !ok {
+            return fmt.Errorf("Database driver does not support restoring")
+        }
+        restore, err := restorer.NewRestore("file:" + path + "?mode=ro")
+        if err != nil {
+            return err
+        }
+        _, err = restore.Step(-1)
+        finishErr := restore.Finish()
+        if err != nil {
+            return err
+        }
+        return finishErr
+    })
+}
+
+// Rotate deletes the oldest automatic backups in dir so that at most keep remain.
+func Rotate(dir string, keep int) error {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+    names := []string{}
+    for _, entry := range entries {
+        name := entry.Name()
+        if !entry.IsDir() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    for len(names) > keep {
+        err = os.Remove(filepath.Join(dir, names[0]))
+        if err != nil {
+            return err
+        }
+        names = names[1:]
+    }
+    return nil
+}
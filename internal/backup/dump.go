@@ -0,0 +1,218 @@
+package backup
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "time"
+)
+
+const dumpVersion = 1
+
+// Dump is the portable form of the database, independent of the SQLite file
+// format, for moving data between instances.
+type Dump struct {
+    Version int `json:"version"`
+    CreatedAt time.Time `json:"created_at"`
+    Tables []TableDump `json:"tables"`
+}
+
+type TableDump struct {
+    Name string `json:"name"`
+    Columns []string `json:"columns"`
+    Rows [][]any `json:"rows"`
+}
+
+func getTableNames(db *sql.DB) ([]string, error) {
+    rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY rowid")
+    if err != nil {
+        return []string{}, err
+    }
+    defer rows.Close()
+
+    names := []string{}
+    for rows.Next() {
+        var name string
+        err = rows.Scan(&name)
+        if err != nil {
+            return []string{}, err
+        }
+        names = append(names, name)
+    }
+    return names, nil
+}
+
+func getTableColumns(db *sql.DB, table string) (map[string]bool, error) {
+    rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+    if err != nil {
+        return map[string]bool{}, err
+    }
+    defer rows.Close()
+
+    columns := map[string]bool{}
+    for rows.Next() {
+        var name string
+        err = rows.Scan(&name)
+        if err != nil {
+            return map[string]bool{}, err
+        }
+        columns[name] = true
+    }
+    return columns, nil
+}
+
+func dumpTable(tx *sql.Tx, table string) (TableDump, error) {
+    rows, err := tx.Query(fmt.Sprintf("SELECT * FROM \"%s\"", table))
+    if err != nil {
+        return TableDump{}, err
+    }
+    defer rows.Close()
+
+    columns, err := rows.Columns()
+    if err != nil {
+        return TableDump{}, err
+    }
+    tableDump := TableDump{ Name: table, Columns: columns, Rows: [][]any{} }
+    for rows.Next() {
+        values := make([]any, len(columns))
+        pointers := make([]any, len(columns))
+        for i := range values {
+            pointers[i] = &values[i]
+        }
+        err = rows.Scan(pointers...)
+        if err != nil {
+            return TableDump{}, err
+        }
+        for i, value := range values {
+            if bytes, ok := value.([]byte); ok {
+                values[i] = string(bytes)
+            }
+        }
+        tableDump.Rows = append(tableDump.Rows, values)
+    }
+    return tableDump, rows.Err()
+}
+
+// WriteDump writes every table as JSON, read inside one transaction so the dump is consistent.
+func WriteDump(db *sql.DB, w io.Writer) error {
+    tables, err := getTableNames(db)
+    if err != nil {
+        return err
+    }
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    dump := Dump{ Version: dumpVersion, CreatedAt: time.Now().UTC(), Tables: []TableDump{} }
+    for _, table := range tables {
+        tableDump, err := dumpTable(tx, table)
+        if err != nil {
+            return fmt.Errorf("Error dumping table %s: %s", table, err)
+        }
+        dump.Tables = append(dump.Tables, tableDump)
+    }
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(dump)
+}
+
+func jsonValue(value any) any {
+    number, ok := value.(json.Number)
+    if !ok {
+        return value
+    }
+    integer, err := number.Int64()
+    if err == nil {
+        return integer
+    }
+    float, err := number.Float64()
+    if err == nil {
+        return float
+    }
+    return number.String()
+}
+
+// LoadDump replaces the content of every table in the dump. The database must
+// already have the schema from init.sql, tables missing in the dump are left alone.
+func LoadDump(db *sql.DB, r io.Reader) error {
+    decoder := json.NewDecoder(r)
+    decoder.UseNumber()
+    var dump Dump
+    err := decoder.Decode(&dump)
+    if err != nil {
+        return err
+    }
+    if dump.Version != dumpVersion {
+        return fmt.Errorf("Unsupported dump version %d", dump.Version)
+    }
+
+    known, err := getTableNames(db)
+    if err != nil {
+        return err
+    }
+    knownTables := map[string]bool{}
+    for _, table := range known {
+        knownTables[table] = true
+    }
+    for _, table := range dump.Tables {
+        if !knownTables[table.Name] {
+            return fmt.Errorf("Table %s does not exist, run init.sql first", table.Name)
+        }
+        columns, err := getTableColumns(db, table.Name)
+        if err != nil {
+            return err
+        }
+        for _, column := range table.Columns {
+            if !columns[column] {
+                return fmt.Errorf("Table %s has no column %s", table.Name, column)
+            }
+        }
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, table := range dump.Tables {
+        _, err = tx.Exec(fmt.Sprintf("DELETE FROM \"%s\"", table.Name))
+        if err != nil {
+            return err
+        }
+        columns := ""
+        placeholders := ""
+        for i, column := range table.Columns {
+            if i > 0 {
+                columns += ", "
+                placeholders += ", "
+            }
+            columns += fmt.Sprintf("\"%s\"", column)
+            placeholders += fmt.Sprintf("$%d", i + 1)
+        }
+        statement, err := tx.Prepare(fmt.Sprintf("INSERT INTO \"%s\" (%s) VALUES(%s)", table.Name, columns, placeholders))
+        if err != nil {
+            return err
+        }
+        for i, row := range table.Rows {
+            if len(row) != len(table.Columns) {
+                statement.Close()
+                return fmt.Errorf("Row %d of table %s has %d values instead of %d", i + 1, table.Name, len(row), len(table.Columns))
+            }
+            values := make([]any, len(row))
+            for j, value := range row {
+                values[j] = jsonValue(value)
+            }
+            _, err = statement.Exec(values...)
+            if err != nil {
+                statement.Close()
+                return fmt.Errorf("Error loading row %d of table %s: %s", i + 1, table.Name, err)
+            }
+        }
+        statement.Close()
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,295 @@
+package config
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io/fs"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/joho/godotenv"
+
+    "zmtwc/sk/internal/logging"
+    "zmtwc/sk/internal/notify"
+)
+
+var CaptchaProviders = []string{ "recaptcha", "hcaptcha", "turnstile", "none" }
+
+var mailModes = []string{ "", "smtp", "file" }
+
+// Config holds every setting of the server and the subcommands. Values come
+// from flags, then the environment, then the optional .env file, then defaults.
+type Config struct {
+    ListenAddr string
+    TLSCertFile string
+    TLSKeyFile string
+    ReadTimeout time.Duration
+    WriteTimeout time.Duration
+    IdleTimeout time.Duration
+    ShutdownTimeout time.Duration
+    DrainDelay time.Duration
+    DBPath string
+    CookieSecure bool
+    SessionLifetime time.Duration
+    CaptchaProvider string
+    CaptchaSiteKey string
+    CaptchaSecretKey string
+    Mail notify.Settings
+    BackupDir string
+    BackupInterval time.Duration
+    BackupKeep int
+    DevMode bool
+    TemplateDir string
+    LogFormat string
+    LogLevel string
+    MetricsListenAddr string
+    MetricsToken string
+}
+
+type envReader struct {
+    problems []string
+}
+
+func (e *envReader) String(name string, fallback string) string {
+    value, ok := os.LookupEnv(name)
+    if !ok || value == "" {
+        return fallback
+    }
+    return value
+}
+
+func (e *envReader) Bool(name string, fallback bool) bool {
+    value := e.String(name, "")
+    if value == "" {
+        return fallback
+    }
+    parsed, err := strconv.ParseBool(value)
+    if err != nil {
+        e.problems = append(e.problems, fmt.Sprintf("%s %s is not true or false", name, value))
+        return fallback
+    }
+    return parsed
+}
+
+func (e *envReader) Duration(name string, fallback time.Duration) time.Duration {
+    value := e.String(name, "")
+    if value == "" {
+        return fallback
+    }
+    parsed, err := time.ParseDuration(value)
+    if err != nil {
+        e.problems = append(e.problems, fmt.Sprintf("%s %s is not a duration like 8h or 30m", name, value))
+        return fallback
+    }
+    return parsed
+}
+
+func (e *envReader) Int(name string, fallback int) int {
+    value := e.String(name, "")
+    if value == "" {
+        return fallback
+    }
+    parsed, err := strconv.Atoi(value)
+    if err != nil {
+        e.problems = append(e.problems, fmt.Sprintf("%s %s is not a number", name, value))
+        return fallback
+    }
+    return parsed
+}
+
+func contains(values []string, value string) bool {
+    for _, candidate := range values {
+        if candidate == value {
+            return true
+        }
+    }
+    return false
+}
+
+// Load reads the configuration and returns it with the arguments left after
+// the flags, which name the subcommand.
+func Load(args []string) (Config, []string, error) {
+    err := godotenv.Load(".env")
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return Config{}, nil, fmt.Errorf("Cannot load .env: %s", err)
+    }
+
+    env := &envReader{}
+    config := Config{
+        ListenAddr: env.String("LISTEN_ADDR", "127.0.0.1:8000"),
+        TLSCertFile: env.String("TLS_CERT_FILE", ""),
+        TLSKeyFile: env.String("TLS_KEY_FILE", ""),
+        ReadTimeout: env.Duration("READ_TIMEOUT", 15 * time.Second),
+        WriteTimeout: env.Duration("WRITE_TIMEOUT", 30 * time.Second),
+        IdleTimeout: env.Duration("IDLE_TIMEOUT", 2 * time.Minute),
+        ShutdownTimeout: env.Duration("SHUTDOWN_TIMEOUT", 20 * time.Second),
+        DrainDelay: env.Duration("DRAIN_DELAY", 5 * time.Second),
+        DBPath: env.String("DB_PATH", "sk.db"),
+        CookieSecure: env.Bool("COOKIE_SECURE", false),
+        SessionLifetime: env.Duration("SESSION_LIFETIME", 8 * time.Hour),
+        CaptchaProvider: env.String("CAPTCHA_PROVIDER", "recaptcha"),
+        CaptchaSiteKey: env.String("CAPTCHA_SITE_KEY", os.Getenv("RECAPTCHA_CLIENT_KEY")),
+        CaptchaSecretKey: env.String("CAPTCHA_SECRET_KEY", os.Getenv("RECAPTCHA_SERVER_KEY")),
+        Mail: notify.Settings{
+            Mode: env.String("MAIL_MODE", ""),
+            From: env.String("MAIL_FROM", ""),
+            Dir: env.String("MAIL_DIR", "mail"),
+            SMTPAddr: env.String("SMTP_ADDR", ""),
+            SMTPUsername: env.String("SMTP_USERNAME", ""),
+            SMTPPassword: env.String("SMTP_PASSWORD", ""),
+        },
+        BackupDir: env.String("BACKUP_DIR", "backups"),
+        BackupInterval: env.Duration("BACKUP_INTERVAL", 0),
+        BackupKeep: env.Int("BACKUP_KEEP", 7),
+        DevMode: env.Bool("DEV_MODE", false),
+        TemplateDir: env.String("TEMPLATE_DIR", "app/templates"),
+        LogFormat: env.String("LOG_FORMAT", "text"),
+        LogLevel: env.String("LOG_LEVEL", "info"),
+        MetricsListenAddr: env.String("METRICS_LISTEN_ADDR", ""),
+        MetricsToken: env.String("METRICS_TOKEN", ""),
+    }
+
+    // secrets are only read from the environment, flags show up in the process list
+    flags := flag.NewFlagSet("sk", flag.ContinueOnError)
+    flags.StringVar(&config.ListenAddr, "listen", config.ListenAddr, "address the server listens on (LISTEN_ADDR)")
+    flags.StringVar(&config.TLSCertFile, "tls-cert", config.TLSCertFile, "certificate file, serves HTTPS together with -tls-key (TLS_CERT_FILE)")
+    flags.StringVar(&config.TLSKeyFile, "tls-key", config.TLSKeyFile, "private key file of the certificate (TLS_KEY_FILE)")
+    flags.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "time allowed to read a request (READ_TIMEOUT)")
+    flags.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "time allowed to write a response, live updates are exempt (WRITE_TIMEOUT)")
+    flags.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "time an idle keep-alive connection stays open (IDLE_TIMEOUT)")
+    flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "time requests get to finish on shutdown (SHUTDOWN_TIMEOUT)")
+    flags.DurationVar(&config.DrainDelay, "drain-delay", config.DrainDelay, "time /readyz reports not ready on shutdown before requests are drained, long enough for a probe to notice, 0 stops right away (DRAIN_DELAY)")
+    flags.StringVar(&config.DBPath, "db", config.DBPath, "path of the SQLite database (DB_PATH)")
+    flags.BoolVar(&config.CookieSecure, "cookie-secure", config.CookieSecure, "only send the session cookie over HTTPS (COOKIE_SECURE)")
+    flags.DurationVar(&config.SessionLifetime, "session-lifetime", config.SessionLifetime, "how long a login stays valid (SESSION_LIFETIME)")
+    flags.StringVar(&config.CaptchaProvider, "captcha", config.CaptchaProvider, "captcha on registration: " + strings.Join(CaptchaProviders, ", ") + " (CAPTCHA_PROVIDER)")
+    flags.StringVar(&config.Mail.Mode, "mail", config.Mail.Mode, "how to send email: smtp, file or empty for none (MAIL_MODE)")
+    flags.StringVar(&config.BackupDir, "backup-dir", config.BackupDir, "directory for backups (BACKUP_DIR)")
+    flags.DurationVar(&config.BackupInterval, "backup-interval", config.BackupInterval, "time between automatic backups, 0 disables them (BACKUP_INTERVAL)")
+    flags.IntVar(&config.BackupKeep, "backup-keep", config.BackupKeep, "number of automatic backups to keep (BACKUP_KEEP)")
+    flags.BoolVar(&config.DevMode, "dev", config.DevMode, "read templates from -template-dir and reload them on change (DEV_MODE)")
+    flags.StringVar(&config.TemplateDir, "template-dir", config.TemplateDir, "template directory used in development mode (TEMPLATE_DIR)")
+    flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "log output: " + strings.Join(logging.Formats, " or ") + " (LOG_FORMAT)")
+    flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "lowest level logged: " + strings.Join(logging.Levels, ", ") + " (LOG_LEVEL)")
+    flags.StringVar(&config.MetricsListenAddr, "metrics-listen", config.MetricsListenAddr, "separate address serving /metrics, otherwise it is served with the app when METRICS_TOKEN is set (METRICS_LISTEN_ADDR)")
+    err = flags.Parse(args)
+    if err != nil {
+        return Config{}, nil, err
+    }
+
+    // the subcommands only touch the database, the server settings need not be complete for them
+    problems := append(env.problems, config.validate()...)
+    if flags.NArg() == 0 || flags.Arg(0) == "serve" {
+        problems = append(problems, config.validateServe()...)
+    }
+    if len(problems) > 0 {
+        return Config{}, nil, fmt.Errorf("Invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+    }
+    return config, flags.Args(), nil
+}
+
+// validate checks the settings every command uses.
+func (c Config) validate() []string {
+    problems := []string{}
+    if c.DBPath == "" {
+        problems = append(problems, "database path is empty")
+    }
+    if c.DevMode {
+        info, err := os.Stat(c.TemplateDir)
+        if err != nil || !info.IsDir() {
+            problems = append(problems, fmt.Sprintf("template directory %s does not exist", c.TemplateDir))
+        }
+    }
+    if !contains(logging.Formats, c.LogFormat) {
+        problems = append(problems, fmt.Sprintf("log format %s is not one of %s", c.LogFormat, strings.Join(logging.Formats, ", ")))
+    }
+    if !contains(logging.Levels, c.LogLevel) {
+        problems = append(problems, fmt.Sprintf("log level %s is not one of %s", c.LogLevel, strings.Join(logging.Levels, ", ")))
+    }
+    if c.BackupInterval < 0 {
+        problems = append(problems, "backup interval cannot be negative")
+    }
+    if c.BackupKeep < 1 {
+        problems = append(problems, "at least one backup has to be kept")
+    }
+    return problems
+}
+
+// validateServe checks the settings only the server uses.
+func (c Config) validateServe() []string {
+    problems := []string{}
+    _, _, err := net.SplitHostPort(c.ListenAddr)
+    if err != nil {
+        problems = append(problems, fmt.Sprintf("listen address %s is not host:port", c.ListenAddr))
+    }
+    if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+        problems = append(problems, "TLS needs both a certificate and a key file")
+    }
+    for _, file := range []string{ c.TLSCertFile, c.TLSKeyFile } {
+        if file == "" {
+            continue
+        }
+        _, err := os.Stat(file)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("cannot read TLS file: %s", err))
+        }
+    }
+    if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.IdleTimeout <= 0 || c.ShutdownTimeout <= 0 {
+        problems = append(problems, "timeouts have to be positive")
+    }
+    if c.DrainDelay < 0 {
+        problems = append(problems, "drain delay cannot be negative")
+    }
+    if c.SessionLifetime < time.Minute {
+        problems = append(problems, "session lifetime has to be at least a minute")
+    }
+    if !contains(CaptchaProviders, c.CaptchaProvider) {
+        problems = append(problems, fmt.Sprintf("captcha provider %s is not one of %s", c.CaptchaProvider, strings.Join(CaptchaProviders, ", ")))
+    } else if c.CaptchaProvider != "none" && (c.CaptchaSiteKey == "" || c.CaptchaSecretKey == "") {
+        problems = append(problems, "CAPTCHA_SITE_KEY and CAPTCHA_SECRET_KEY are required unless the captcha provider is none")
+    }
+    if !contains(mailModes, c.Mail.Mode) {
+        problems = append(problems, fmt.Sprintf("mail mode %s is not one of smtp or file", c.Mail.Mode))
+    } else if c.Mail.Mode == "smtp" && (c.Mail.SMTPAddr == "" || c.Mail.From == "") {
+        problems = append(problems, "SMTP_ADDR and MAIL_FROM are required for smtp mail mode")
+    }
+    if c.MetricsListenAddr != "" {
+        _, _, err := net.SplitHostPort(c.MetricsListenAddr)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("metrics listen address %s is not host:port", c.MetricsListenAddr))
+        } else if c.MetricsListenAddr == c.ListenAddr {
+            problems = append(problems, "metrics listen address has to differ from the listen address")
+        }
+    }
+    return problems
+}
+
+func redact(secret string) string {
+    if secret == "" {
+        return "(not set)"
+    }
+    return "(set)"
+}
+
+// Redacted lists the settings for the startup log with secrets left out.
+func (c Config) Redacted() string {
+    lines := []string{
+        fmt.Sprintf("listen address: %s", c.ListenAddr),
+        fmt.Sprintf("TLS: certificate %q, key %q", c.TLSCertFile, c.TLSKeyFile),
+        fmt.Sprintf("timeouts: read %s, write %s, idle %s, shutdown %s, drain delay %s", c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.ShutdownTimeout, c.DrainDelay),
+        fmt.Sprintf("database: %s", c.DBPath),
+        fmt.Sprintf("secure cookies: %t", c.CookieSecure),
+        fmt.Sprintf("session lifetime: %s", c.SessionLifetime),
+        fmt.Sprintf("captcha: %s, site key %s, secret key %s", c.CaptchaProvider, redact(c.CaptchaSiteKey), redact(c.CaptchaSecretKey)),
+        fmt.Sprintf("mail: %q from %q, directory %s, smtp %q user %q password %s", c.Mail.Mode, c.Mail.From, c.Mail.Dir, c.Mail.SMTPAddr, c.Mail.SMTPUsername, redact(c.Mail.SMTPPassword)),
+        fmt.Sprintf("backups: every %s into %s, keeping %d", c.BackupInterval, c.BackupDir, c.BackupKeep),
+        fmt.Sprintf("development mode: %t, template directory %s", c.DevMode, c.TemplateDir),
+        fmt.Sprintf("logging: %s from level %s", c.LogFormat, c.LogLevel),
+        fmt.Sprintf("metrics: listen address %q, token %s", c.MetricsListenAddr, redact(c.MetricsToken)),
+    }
+    return strings.Join(lines, "\n")
+}
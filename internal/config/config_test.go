@@ -0,0 +1,53 @@
+package config
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestLoadChecksServerSettingsOnlyForServe(t *testing.T) {
+    t.Setenv("CAPTCHA_PROVIDER", "recaptcha")
+    t.Setenv("CAPTCHA_SITE_KEY", "")
+    t.Setenv("CAPTCHA_SECRET_KEY", "")
+    t.Setenv("RECAPTCHA_CLIENT_KEY", "")
+    t.Setenv("RECAPTCHA_SERVER_KEY", "")
+
+    for _, args := range [][]string{ { "migrate" }, { "backup" }, { "user", "create", "alice" } } {
+        _, rest, err := Load(args)
+        if err != nil {
+            t.Errorf("sk %s: %s", strings.Join(args, " "), err)
+        } else if rest[0] != args[0] {
+            t.Errorf("sk %s: got command %s", strings.Join(args, " "), rest[0])
+        }
+    }
+    for _, args := range [][]string{ {}, { "serve" } } {
+        _, _, err := Load(args)
+        if err == nil || !strings.Contains(err.Error(), "CAPTCHA_SITE_KEY") {
+            t.Errorf("sk %s: got error %v, want missing captcha keys", strings.Join(args, " "), err)
+        }
+    }
+}
+
+func TestLoadRefusesMemoryMailMode(t *testing.T) {
+    t.Setenv("CAPTCHA_PROVIDER", "none")
+    t.Setenv("MAIL_MODE", "memory")
+
+    _, _, err := Load([]string{ "serve" })
+    if err == nil || !strings.Contains(err.Error(), "mail mode memory") {
+        t.Errorf("got error %v, want the mail mode refused", err)
+    }
+}
+
+func TestLoadDrainsLongEnoughForAProbe(t *testing.T) {
+    t.Setenv("CAPTCHA_PROVIDER", "none")
+    t.Setenv("DRAIN_DELAY", "")
+
+    config, _, err := Load([]string{ "serve" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if config.DrainDelay < time.Second {
+        t.Errorf("got drain delay %s, want at least a second so /readyz is probed while draining", config.DrainDelay)
+    }
+}
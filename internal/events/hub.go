@@ -0,0 +1,85 @@
+package events
+
+import (
+    "sync"
+)
+
+const (
+    TaskChanged = "task-changed"
+    TaskDeleted = "task-deleted"
+)
+
+type Event struct {
+    Kind string
+    ID int64
+}
+
+// Hub fans events out to everyone subscribed to the same topic, e.g. a story.
+// Slow subscribers miss events instead of blocking the publisher.
+type Hub struct {
+    mu sync.Mutex
+    subscribers map[int64]map[chan Event]struct{}
+    closed bool
+}
+
+func NewHub() *Hub {
+    return &Hub{ subscribers: map[int64]map[chan Event]struct{}{} }
+}
+
+// Subscribe returns a channel with the events of the topic and a function that
+// has to be called once the subscriber is gone. The channel is closed when the
+// hub is closed.
+func (h *Hub) Subscribe(topic int64) (<-chan Event, func()) {
+    ch := make(chan Event, 16)
+    h.mu.Lock()
+    if h.closed {
+        h.mu.Unlock()
+        close(ch)
+        return ch, func() {}
+    }
+    if h.subscribers[topic] == nil {
+        h.subscribers[topic] = map[chan Event]struct{}{}
+    }
+    h.subscribers[topic][ch] = struct{}{}
+    h.mu.Unlock()
+
+    var once sync.Once
+    return ch, func() {
+        once.Do(func() {
+            h.mu.Lock()
+            defer h.mu.Unlock()
+            if _, ok := h.subscribers[topic][ch]; !ok {
+                return
+            }
+            delete(h.subscribers[topic], ch)
+            if len(h.subscribers[topic]) == 0 {
+                delete(h.subscribers, topic)
+            }
+            close(ch)
+        })
+    }
+}
+
+func (h *Hub) Publish(topic int64, event Event) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for ch := range h.subscribers[topic] {
+        select {
+        case ch <- event:
+        default:
+        }
+    }
+}
+
+// Close ends every subscription, e.g. to let streaming requests finish on shutdown.
+func (h *Hub) Close() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.closed = true
+    for topic, subscribers := range h.subscribers {
+        for ch := range subscribers {
+            close(ch)
+        }
+        delete(h.subscribers, topic)
+    }
+}
@@ -0,0 +1,107 @@
+package ical
+
+import (
+    "fmt"
+    "io"
+    "strings"
+    "time"
+)
+
+const timeFormat = "20060102T150405Z"
+
+type Event struct {
+    UID string
+    Summary string
+    Description string
+    Start time.Time
+    End time.Time
+    Stamp time.Time
+}
+
+type Calendar struct {
+    Name string
+    Events []Event
+}
+
+var textEscaper = strings.NewReplacer(
+    "\\", "\\\\",
+    ";", "\\;",
+    ",", "\\,",
+    "\r\n", "\\n",
+    "\n", "\\n",
+)
+
+// fold breaks content lines longer than 75 octets as RFC 5545 requires.
+func fold(line string) string {
+    if len(line) <= 75 {
+        return line
+    }
+    var builder strings.Builder
+    width := 0
+    for _, r := range line {
+        size := len(string(r))
+        if width + size > 75 {
+            builder.WriteString("\r\n ")
+            width = 1
+        }
+        builder.WriteRune(r)
+        width += size
+    }
+    return builder.String()
+}
+
+func writeLine(w io.Writer, name string, value string) error {
+    _, err := io.WriteString(w, fold(name + ":" + value) + "\r\n")
+    return err
+}
+
+func Write(w io.Writer, calendar Calendar) error {
+    lines := [][2]string{
+        {"BEGIN", "VCALENDAR"},
+        {"VERSION", "2.0"},
+        {"PRODID", "-//zmtwc//sk//EN"},
+        {"CALSCALE", "GREGORIAN"},
+        {"METHOD", "PUBLISH"},
+    }
+    if calendar.Name != "" {
+        lines = append(lines, [2]string{"X-WR-CALNAME", textEscaper.Replace(calendar.Name)})
+    }
+    for _, line := range lines {
+        err := writeLine(w, line[0], line[1])
+        if err != nil {
+            return err
+        }
+    }
+
+    for _, event := range calendar.Events {
+        stamp := event.Stamp
+        if stamp.IsZero() {
+            stamp = time.Now()
+        }
+        eventLines := [][2]string{
+            {"BEGIN", "VEVENT"},
+            {"UID", event.UID},
+            {"DTSTAMP", stamp.UTC().Format(timeFormat)},
+            {"DTSTART", event.Start.UTC().Format(timeFormat)},
+            {"DTEND", event.End.UTC().Format(timeFormat)},
+            {"SUMMARY", textEscaper.Replace(event.Summary)},
+        }
+        if event.Description != "" {
+            eventLines = append(eventLines, [2]string{"DESCRIPTION", textEscaper.Replace(event.Description)})
+        }
+        eventLines = append(eventLines, [2]string{"END", "VEVENT"})
+        for _, line := range eventLines {
+            err := writeLine(w, line[0], line[1])
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    return writeLine(w, "END", "VCALENDAR")
+}
+
+// EventUID builds a stable identifier so calendar clients update events instead of duplicating them.
+func EventUID(kind string, id int64) string {
+    return fmt.Sprintf("%s-%d@zmtwc-sk", kind, id)
+}
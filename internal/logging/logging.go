@@ -0,0 +1,188 @@
+package logging
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+var Formats = []string{ "text", "json" }
+
+var Levels = []string{ "debug", "info", "warn", "error" }
+
+// request IDs passed in by a proxy are kept when they are safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type contextKey struct{}
+
+// requestInfo is filled in while the request is handled and logged once it is done.
+type requestInfo struct {
+    id string
+    route string
+    userID int64
+}
+
+func infoFromContext(ctx context.Context) *requestInfo {
+    info, _ := ctx.Value(contextKey{}).(*requestInfo)
+    return info
+}
+
+// contextHandler adds the request ID to every record logged with the context of a request.
+type contextHandler struct {
+    slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+    info := infoFromContext(ctx)
+    if info != nil {
+        record.AddAttrs(slog.String("request_id", info.id))
+    }
+    return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return contextHandler{ h.Handler.WithAttrs(attrs) }
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+    return contextHandler{ h.Handler.WithGroup(name) }
+}
+
+// New builds a logger writing records to w in the format, text or json,
+// leaving out records below the level.
+func New(w io.Writer, format string, level string) (*slog.Logger, error) {
+    var minimum slog.Level
+    err := minimum.UnmarshalText([]byte(level))
+    if err != nil {
+        return nil, fmt.Errorf("Unknown log level %s", level)
+    }
+    options := &slog.HandlerOptions{ Level: minimum }
+    switch strings.ToLower(format) {
+    case "text":
+        return slog.New(contextHandler{ slog.NewTextHandler(w, options) }), nil
+    case "json":
+        return slog.New(contextHandler{ slog.NewJSONHandler(w, options) }), nil
+    }
+    return nil, fmt.Errorf("Unknown log format %s", format)
+}
+
+// RequestID returns the ID of the request the context belongs to, or "".
+func RequestID(ctx context.Context) string {
+    info := infoFromContext(ctx)
+    if info == nil {
+        return ""
+    }
+    return info.id
+}
+
+// SetUserID records the logged in user of the request for the request log.
+func SetUserID(r *http.Request, userID int64) {
+    info := infoFromContext(r.Context())
+    if info != nil {
+        info.userID = userID
+    }
+}
+
+// Summary describes a finished request for observers like the metrics.
+type Summary struct {
+    Method string
+    Route string
+    Status int
+    Latency time.Duration
+}
+
+// statusRecorder remembers the status and size of the response. Unwrap lets
+// http.ResponseController reach the flusher and deadlines of the connection.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    size int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+    if s.status == 0 {
+        s.status = status
+    }
+    s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+    if s.status == 0 {
+        s.status = http.StatusOK
+    }
+    n, err := s.ResponseWriter.Write(data)
+    s.size += n
+    return n, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
+
+// Middleware assigns every request an ID, sends it back in the X-Request-ID
+// header and logs the request once the response is written, then passes the
+// summary to the observers. Only the route template is logged, the path itself
+// can hold calendar and invite tokens.
+func Middleware(next http.Handler, observers ...func(Summary)) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        id := r.Header.Get(RequestIDHeader)
+        if !validRequestID.MatchString(id) {
+            id = uuid.New().String()
+        }
+        info := &requestInfo{ id: id }
+        w.Header().Set(RequestIDHeader, id)
+        recorder := &statusRecorder{ ResponseWriter: w }
+        ctx := context.WithValue(r.Context(), contextKey{}, info)
+
+        next.ServeHTTP(recorder, r.WithContext(ctx))
+
+        status := recorder.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        level := slog.LevelInfo
+        if status >= 500 {
+            level = slog.LevelError
+        }
+        latency := time.Since(start)
+        slog.LogAttrs(ctx, level, "Request",
+            slog.String("method", r.Method),
+            slog.String("route", info.route),
+            slog.Int("status", status),
+            slog.Int("size", recorder.size),
+            slog.Duration("latency", latency),
+            slog.Int64("user_id", info.userID),
+        )
+        for _, observe := range observers {
+            observe(Summary{ Method: r.Method, Route: info.route, Status: status, Latency: latency })
+        }
+    })
+}
+
+// RouteMiddleware records the matched route template, e.g. /story/{id}, so
+// requests to the same handler can be grouped. It has to be used on the router,
+// which only knows the route once it matched the request.
+func RouteMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        info := infoFromContext(r.Context())
+        route := mux.CurrentRoute(r)
+        if info != nil && route != nil {
+            template, err := route.GetPathTemplate()
+            if err == nil {
+                info.route = template
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+    "bytes"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/mux"
+)
+
+func TestMiddlewareLogsRouteNotPath(t *testing.T) {
+    var output bytes.Buffer
+    logger, err := New(&output, "json", "info")
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := slog.Default()
+    slog.SetDefault(logger)
+    defer slog.SetDefault(previous)
+
+    router := mux.NewRouter()
+    router.Use(RouteMiddleware)
+    router.HandleFunc("/calendar/{token}", func(w http.ResponseWriter, r *http.Request) {})
+    var summaries []Summary
+    handler := Middleware(router, func(summary Summary) {
+        summaries = append(summaries, summary)
+    })
+
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/calendar/secret-token", nil))
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/invite/secret-token/extra", nil))
+
+    if strings.Contains(output.String(), "secret-token") {
+        t.Errorf("request log contains the token:\n%s", output.String())
+    }
+    if !strings.Contains(output.String(), `"route":"/calendar/{token}"`) {
+        t.Errorf("request log misses the route:\n%s", output.String())
+    }
+    if len(summaries) != 2 || summaries[0].Route != "/calendar/{token}" || summaries[1].Route != "" || summaries[1].Status != http.StatusNotFound {
+        t.Errorf("got summaries %+v", summaries)
+    }
+}
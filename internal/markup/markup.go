@@ -0,0 +1,79 @@
+package markup
+
+import (
+    "html"
+    "html/template"
+    "regexp"
+    "strings"
+)
+
+var boldPattern = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+var italicPattern = regexp.MustCompile(`\*([^*]+)\*`)
+var linkPattern = regexp.MustCompile(`\[([^\]]+)\]\(((?:https?://|mailto:)[^\s)*]+)\)`)
+
+// inline escapes and formats a single line; text between backticks is kept as code.
+func inline(line string) string {
+    parts := strings.Split(line, "`")
+    if len(parts) % 2 == 0 {
+        // unmatched backtick, keep the last one as plain text
+        parts[len(parts) - 2] += "`" + parts[len(parts) - 1]
+        parts = parts[:len(parts) - 1]
+    }
+    for i, part := range parts {
+        escaped := html.EscapeString(part)
+        if i % 2 == 1 {
+            parts[i] = "<code>" + escaped + "</code>"
+            continue
+        }
+        escaped = linkPattern.ReplaceAllString(escaped, `<a href="$2" rel="nofollow noopener" target="_blank">$1</a>`)
+        escaped = boldPattern.ReplaceAllString(escaped, "<strong>$1</strong>")
+        escaped = italicPattern.ReplaceAllString(escaped, "<em>$1</em>")
+        parts[i] = escaped
+    }
+    return strings.Join(parts, "")
+}
+
+func isListItem(line string) bool {
+    return strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ")
+}
+
+// Render turns a small Markdown subset (paragraphs, "- " lists, **bold**, *italic*,
+// `code` and [links](https://...)) into HTML. Everything else is escaped.
+func Render(text string) template.HTML {
+    text = strings.ReplaceAll(text, "\r\n", "\n")
+    var builder strings.Builder
+    for _, block := range strings.Split(text, "\n\n") {
+        block = strings.Trim(block, "\n")
+        if strings.TrimSpace(block) == "" {
+            continue
+        }
+
+        paragraph := []string{}
+        list := []string{}
+        flush := func() {
+            if len(paragraph) > 0 {
+                builder.WriteString("<p>" + strings.Join(paragraph, "<br>") + "</p>")
+                paragraph = []string{}
+            }
+            if len(list) > 0 {
+                builder.WriteString("<ul><li>" + strings.Join(list, "</li><li>") + "</li></ul>")
+                list = []string{}
+            }
+        }
+        for _, line := range strings.Split(block, "\n") {
+            if isListItem(line) {
+                if len(paragraph) > 0 {
+                    flush()
+                }
+                list = append(list, inline(line[2:]))
+                continue
+            }
+            if len(list) > 0 {
+                flush()
+            }
+            paragraph = append(paragraph, inline(line))
+        }
+        flush()
+    }
+    return template.HTML(builder.String())
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+    "context"
+    "database/sql/driver"
+    "time"
+)
+
+// ObservedDriver wraps a database driver and reports how long every statement
+// took, with operation "exec" or "query". Queries are timed until the first
+// rows are ready, reading the rest of the rows is not included.
+type ObservedDriver struct {
+    Driver driver.Driver
+    Observe func(operation string, duration time.Duration)
+}
+
+func (d ObservedDriver) Open(name string) (driver.Conn, error) {
+    conn, err := d.Driver.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    return &observedConn{ Conn: conn, observe: d.Observe }, nil
+}
+
+type observedConn struct {
+    driver.Conn
+    observe func(string, time.Duration)
+}
+
+// Unwrap returns the connection of the wrapped driver, for driver specific
+// features like the SQLite backup API.
+func (c *observedConn) Unwrap() driver.Conn {
+    return c.Conn
+}
+
+func (c *observedConn) Prepare(query string) (driver.Stmt, error) {
+    return c.PrepareContext(context.Background(), query)
+}
+
+func (c *observedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+    var stmt driver.Stmt
+    var err error
+    if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+        stmt, err = preparer.PrepareContext(ctx, query)
+    } else {
+        stmt, err = c.Conn.Prepare(query)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &observedStmt{ Stmt: stmt, observe: c.observe }, nil
+}
+
+func (c *observedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+    if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+        return beginner.BeginTx(ctx, opts)
+    }
+    return c.Conn.Begin()
+}
+
+func (c *observedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+    execer, ok := c.Conn.(driver.ExecerContext)
+    if !ok {
+        return nil, driver.ErrSkip
+    }
+    start := time.Now()
+    result, err := execer.ExecContext(ctx, query, args)
+    c.observe("exec", time.Since(start))
+    return result, err
+}
+
+func (c *observedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+    queryer, ok := c.Conn.(driver.QueryerContext)
+    if !ok {
+        return nil, driver.ErrSkip
+    }
+    start := time.Now()
+    rows, err := queryer.QueryContext(ctx, query, args)
+    c.observe("query", time.Since(start))
+    return rows, err
+}
+
+func (c *observedConn) Ping(ctx context.Context) error {
+    if pinger, ok := c.Conn.(driver.Pinger); ok {
+        return pinger.Ping(ctx)
+    }
+    return nil
+}
+
+type observedStmt struct {
+    driver.Stmt
+    observe func(string, time.Duration)
+}
+
+func (s *observedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+    start := time.Now()
+    defer func() { s.observe("exec", time.Since(start)) }()
+    if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+        return execer.ExecContext(ctx, args)
+    }
+    values, err := namedValues(args)
+    if err != nil {
+        return nil, err
+    }
+    return s.Stmt.Exec(values)
+}
+
+func (s *observedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+    start := time.Now()
+    defer func() { s.observe("query", time.Since(start)) }()
+    if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+        return queryer.QueryContext(ctx, args)
+    }
+    values, err := namedValues(args)
+    if err != nil {
+        return nil, err
+    }
+    return s.Stmt.Query(values)
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+    values := make([]driver.Value, len(args))
+    for i, arg := range args {
+        if arg.Name != "" {
+            return nil, driver.ErrSkip
+        }
+        values[i] = arg.Value
+    }
+    return values, nil
+}
@@ -0,0 +1,256 @@
+package metrics
+
+import (
+    "bufio"
+    "crypto/subtle"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// DefaultBuckets are the upper bounds in seconds used for latency histograms.
+var DefaultBuckets = []float64{ 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10 }
+
+type metric interface {
+    write(w *bufio.Writer) error
+}
+
+// Registry holds the metrics and writes them in the Prometheus text format.
+type Registry struct {
+    mu sync.Mutex
+    metrics []metric
+}
+
+func NewRegistry() *Registry {
+    return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.metrics = append(r.metrics, m)
+}
+
+func escapeLabel(value string) string {
+    value = strings.ReplaceAll(value, `\`, `\\`)
+    value = strings.ReplaceAll(value, "\n", `\n`)
+    return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func formatValue(value float64) string {
+    if math.IsInf(value, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// formatLabels renders {name="value",...}, extra is appended as is, e.g. a histogram bucket.
+func formatLabels(names []string, values []string, extra string) string {
+    parts := []string{}
+    for i, name := range names {
+        parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+    }
+    if extra != "" {
+        parts = append(parts, extra)
+    }
+    if len(parts) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, kind string) {
+    fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+    fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func seriesKey(labelValues []string) string {
+    return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](series map[string]V) []string {
+    keys := make([]string, 0, len(series))
+    for key := range series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+type counterSeries struct {
+    labelValues []string
+    value float64
+}
+
+// CounterVec counts events per combination of label values.
+type CounterVec struct {
+    name string
+    help string
+    labels []string
+    mu sync.Mutex
+    series map[string]*counterSeries
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+    counter := &CounterVec{ name: name, help: help, labels: labels, series: map[string]*counterSeries{} }
+    r.register(counter)
+    return counter
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+    key := seriesKey(labelValues)
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    series, ok := c.series[key]
+    if !ok {
+        series = &counterSeries{ labelValues: labelValues }
+        c.series[key] = series
+    }
+    series.value += value
+}
+
+func (c *CounterVec) write(w *bufio.Writer) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    writeHeader(w, c.name, c.help, "counter")
+    for _, key := range sortedKeys(c.series) {
+        series := c.series[key]
+        fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, series.labelValues, ""), formatValue(series.value))
+    }
+    return nil
+}
+
+type histogramSeries struct {
+    labelValues []string
+    counts []uint64
+    count uint64
+    sum float64
+}
+
+// HistogramVec counts observations into buckets per combination of label values.
+type HistogramVec struct {
+    name string
+    help string
+    labels []string
+    buckets []float64
+    mu sync.Mutex
+    series map[string]*histogramSeries
+}
+
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+    histogram := &HistogramVec{ name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{} }
+    r.register(histogram)
+    return histogram
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+    key := seriesKey(labelValues)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    series, ok := h.series[key]
+    if !ok {
+        series = &histogramSeries{ labelValues: labelValues, counts: make([]uint64, len(h.buckets)) }
+        h.series[key] = series
+    }
+    for i, bound := range h.buckets {
+        if value <= bound {
+            series.counts[i]++
+        }
+    }
+    series.count++
+    series.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    writeHeader(w, h.name, h.help, "histogram")
+    for _, key := range sortedKeys(h.series) {
+        series := h.series[key]
+        for i, bound := range h.buckets {
+            bucket := fmt.Sprintf(`le="%s"`, formatValue(bound))
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, series.labelValues, bucket), series.counts[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, series.labelValues, `le="+Inf"`), series.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, series.labelValues, ""), formatValue(series.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, series.labelValues, ""), series.count)
+    }
+    return nil
+}
+
+// GaugeFunc reads its value when the metrics are scraped, e.g. from the database.
+type GaugeFunc struct {
+    name string
+    help string
+    read func() (float64, error)
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, read func() (float64, error)) *GaugeFunc {
+    gauge := &GaugeFunc{ name: name, help: help, read: read }
+    r.register(gauge)
+    return gauge
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) error {
+    value, err := g.read()
+    if err != nil {
+        return fmt.Errorf("Error reading %s: %s", g.name, err)
+    }
+    writeHeader(w, g.name, g.help, "gauge")
+    fmt.Fprintf(w, "%s %s\n", g.name, formatValue(value))
+    return nil
+}
+
+// Write writes every metric. A gauge that cannot be read is left out and
+// reported in the returned error, the other metrics are still written.
+func (r *Registry) Write(w io.Writer) error {
+    r.mu.Lock()
+    metrics := append([]metric{}, r.metrics...)
+    r.mu.Unlock()
+
+    buffered := bufio.NewWriter(w)
+    problems := []string{}
+    for _, m := range metrics {
+        err := m.write(buffered)
+        if err != nil {
+            problems = append(problems, err.Error())
+        }
+    }
+    err := buffered.Flush()
+    if err != nil {
+        return err
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("%s", strings.Join(problems, ", "))
+    }
+    return nil
+}
+
+// Handler serves the metrics, requiring "Authorization: Bearer <token>" unless
+// the token is empty. onError receives problems reading single metrics.
+func (r *Registry) Handler(token string, onError func(*http.Request, error)) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if token != "" {
+            given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+            if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                http.Error(w, "Missing or wrong metrics token", 401)
+                return
+            }
+        }
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        err := r.Write(w)
+        if err != nil && onError != nil {
+            onError(req, err)
+        }
+    })
+}
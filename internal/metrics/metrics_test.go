@@ -0,0 +1,69 @@
+package metrics
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+    registry := NewRegistry()
+    requests := registry.NewCounterVec("sk_requests_total", "Requests handled.", "method", "route")
+    requests.Inc("GET", "/story/{id}")
+    requests.Add(2, "POST", `/a"b\c` + "\n")
+    requests.Inc("GET", "/story/{id}")
+    latency := registry.NewHistogramVec("sk_latency_seconds", "Request latency.", []float64{ 0.1, 1 }, "route")
+    latency.Observe(0.05, "/")
+    latency.Observe(0.5, "/")
+    latency.Observe(3, "/")
+    registry.NewGaugeFunc("sk_users", "Registered users.", func() (float64, error) { return 42, nil })
+    registry.NewGaugeFunc("sk_broken", "Cannot be read.", func() (float64, error) { return 0, errors.New("database is locked") })
+
+    var output strings.Builder
+    err := registry.Write(&output)
+    if err == nil || !strings.Contains(err.Error(), "sk_broken") || !strings.Contains(err.Error(), "database is locked") {
+        t.Errorf("got error %v, want the broken gauge reported", err)
+    }
+
+    want := `# HELP sk_requests_total Requests handled.
+# TYPE sk_requests_total counter
+sk_requests_total{method="GET",route="/story/{id}"} 2
+sk_requests_total{method="POST",route="/a\"b\\c\n"} 2
+# HELP sk_latency_seconds Request latency.
+# TYPE sk_latency_seconds histogram
+sk_latency_seconds_bucket{route="/",le="0.1"} 1
+sk_latency_seconds_bucket{route="/",le="1"} 2
+sk_latency_seconds_bucket{route="/",le="+Inf"} 3
+sk_latency_seconds_sum{route="/"} 3.55
+sk_latency_seconds_count{route="/"} 3
+# HELP sk_users Registered users.
+# TYPE sk_users gauge
+sk_users 42
+`
+    if output.String() != want {
+        t.Errorf("got\n%s\nwant\n%s", output.String(), want)
+    }
+}
+
+func TestHandlerRequiresToken(t *testing.T) {
+    registry := NewRegistry()
+    registry.NewCounterVec("sk_requests_total", "Requests handled.").Inc()
+    handler := registry.Handler("secret", nil)
+
+    for header, status := range map[string]int{ "": 401, "Bearer wrong": 401, "Bearer secret": 200 } {
+        request := httptest.NewRequest("GET", "/metrics", nil)
+        if header != "" {
+            request.Header.Set("Authorization", header)
+        }
+        recorder := httptest.NewRecorder()
+        handler.ServeHTTP(recorder, request)
+        if recorder.Code != status {
+            t.Errorf("Authorization %q: got status %d, want %d", header, recorder.Code, status)
+        }
+        if status == http.StatusOK && !strings.Contains(recorder.Body.String(), "sk_requests_total 1\n") {
+            t.Errorf("got body %s", recorder.Body.String())
+        }
+    }
+}
@@ -0,0 +1,118 @@
+package notify
+
+import (
+    "fmt"
+    "net/smtp"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+type Message struct {
+    To string
+    Subject string
+    Body string
+}
+
+type Mailer interface {
+    Send(message Message) error
+}
+
+type SMTPMailer struct {
+    Addr string
+    From string
+    Username string
+    Password string
+}
+
+func formatMessage(from string, message Message) []byte {
+    var builder strings.Builder
+    fmt.Fprintf(&builder, "From: %s\r\n", from)
+    fmt.Fprintf(&builder, "To: %s\r\n", message.To)
+    fmt.Fprintf(&builder, "Subject: %s\r\n", message.Subject)
+    fmt.Fprintf(&builder, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    builder.WriteString("MIME-Version: 1.0\r\n")
+    builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    builder.WriteString("\r\n")
+    builder.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+    return []byte(builder.String())
+}
+
+func (m SMTPMailer) Send(message Message) error {
+    var auth smtp.Auth
+    if m.Username != "" {
+        host := m.Addr
+        if i := strings.LastIndex(host, ":"); i >= 0 {
+            host = host[:i]
+        }
+        auth = smtp.PlainAuth("", m.Username, m.Password, host)
+    }
+    return smtp.SendMail(m.Addr, auth, m.From, []string{message.To}, formatMessage(m.From, message))
+}
+
+// FileMailer stores every message as an .eml file, which is handy for local development.
+type FileMailer struct {
+    Dir string
+    From string
+}
+
+func (m FileMailer) Send(message Message) error {
+    err := os.MkdirAll(m.Dir, 0755)
+    if err != nil {
+        return err
+    }
+    name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(message.To))
+    return os.WriteFile(filepath.Join(m.Dir, name), formatMessage(m.From, message), 0644)
+}
+
+// MemoryMailer keeps sent messages in memory so tests can inspect them.
+type MemoryMailer struct {
+    mu sync.Mutex
+    messages []Message
+}
+
+func (m *MemoryMailer) Send(message Message) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.messages = append(m.messages, message)
+    return nil
+}
+
+func (m *MemoryMailer) Messages() []Message {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return append([]Message{}, m.messages...)
+}
+
+type Settings struct {
+    Mode string
+    From string
+    Dir string
+    SMTPAddr string
+    SMTPUsername string
+    SMTPPassword string
+}
+
+// NewMailer picks the mailer by mode (smtp or file).
+// It returns nil when the mode is empty and mail is not configured.
+func NewMailer(settings Settings) (Mailer, error) {
+    switch settings.Mode {
+    case "":
+        return nil, nil
+    case "smtp":
+        if settings.SMTPAddr == "" || settings.From == "" {
+            return nil, fmt.Errorf("SMTP address and sender are required for smtp mail mode")
+        }
+        return SMTPMailer{
+            Addr: settings.SMTPAddr,
+            From: settings.From,
+            Username: settings.SMTPUsername,
+            Password: settings.SMTPPassword,
+        }, nil
+    case "file":
+        return FileMailer{ Dir: settings.Dir, From: settings.From }, nil
+    }
+    return nil, fmt.Errorf("Unknown mail mode %s", settings.Mode)
+}
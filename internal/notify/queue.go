@@ -0,0 +1,69 @@
+package notify
+
+import (
+    "log/slog"
+    "sync"
+)
+
+// Queue delivers messages in the background so request handlers never wait for the mail server.
+type Queue struct {
+    mailer Mailer
+    messages chan Message
+    wg sync.WaitGroup
+    mu sync.Mutex
+    closed bool
+}
+
+func NewQueue(mailer Mailer, size int) *Queue {
+    q := &Queue{
+        mailer: mailer,
+        messages: make(chan Message, size),
+    }
+    q.wg.Add(1)
+    go q.run()
+    return q
+}
+
+func (q *Queue) run() {
+    defer q.wg.Done()
+    for message := range q.messages {
+        err := q.mailer.Send(message)
+        if err != nil {
+            slog.Error("Error sending mail", "to", message.To, "error", err)
+        }
+    }
+}
+
+// Enqueue adds the message to the queue, dropping it when the queue is full.
+func (q *Queue) Enqueue(message Message) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.closed {
+        return false
+    }
+    select {
+    case q.messages <- message:
+        return true
+    default:
+        slog.Warn("Mail queue is full, dropping mail", "to", message.To)
+        return false
+    }
+}
+
+// Running reports whether the queue still accepts messages.
+func (q *Queue) Running() bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return !q.closed
+}
+
+// Close stops accepting messages and waits until the queued ones are sent.
+func (q *Queue) Close() {
+    q.mu.Lock()
+    if !q.closed {
+        q.closed = true
+        close(q.messages)
+    }
+    q.mu.Unlock()
+    q.wg.Wait()
+}
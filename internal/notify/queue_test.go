@@ -0,0 +1,22 @@
+package notify
+
+import (
+    "testing"
+)
+
+func TestQueueDeliversAfterClose(t *testing.T) {
+    mailer := &MemoryMailer{}
+    queue := NewQueue(mailer, 10)
+    for i := 0; i < 5; i++ {
+        if !queue.Enqueue(Message{ To: "user@example.com", Subject: "Hello" }) {
+            t.Fatal("queue refused a message while running")
+        }
+    }
+    queue.Close()
+    if queue.Enqueue(Message{ To: "user@example.com" }) {
+        t.Error("queue accepted a message after Close")
+    }
+    if len(mailer.Messages()) != 5 {
+        t.Errorf("sent %d mails, want 5", len(mailer.Messages()))
+    }
+}
@@ -0,0 +1,76 @@
+package scheduler
+
+import (
+    "sync"
+    "time"
+)
+
+// Clock is the source of time for the scheduler, so tests can drive it by hand.
+type Clock interface {
+    Now() time.Time
+    After(d time.Duration) <-chan time.Time
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+    return time.Now()
+}
+
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+    return time.After(d)
+}
+
+type manualTimer struct {
+    at time.Time
+    c chan time.Time
+}
+
+// ManualClock only moves when Advance is called.
+type ManualClock struct {
+    mu sync.Mutex
+    now time.Time
+    timers []manualTimer
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+    return &ManualClock{ now: now }
+}
+
+func (c *ManualClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    timer := manualTimer{ at: c.now.Add(d), c: make(chan time.Time, 1) }
+    c.timers = append(c.timers, timer)
+    return timer.c
+}
+
+// Waiting returns how many timers have not fired yet, so a test can tell when
+// a scheduler finished its job and waits for the next interval.
+func (c *ManualClock) Waiting() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return len(c.timers)
+}
+
+// Advance moves the clock forward and fires every timer that became due.
+func (c *ManualClock) Advance(d time.Duration) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.now = c.now.Add(d)
+    pending := []manualTimer{}
+    for _, timer := range c.timers {
+        if timer.at.After(c.now) {
+            pending = append(pending, timer)
+            continue
+        }
+        timer.c <- c.now
+    }
+    c.timers = pending
+}
@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type Job func(now time.Time)
+
+// Scheduler runs a job right away and then once every interval until stopped.
+type Scheduler struct {
+    clock Clock
+    interval time.Duration
+    job Job
+    stop chan struct{}
+    once sync.Once
+    wg sync.WaitGroup
+    running atomic.Bool
+}
+
+func New(clock Clock, interval time.Duration, job Job) *Scheduler {
+    return &Scheduler{
+        clock: clock,
+        interval: interval,
+        job: job,
+        stop: make(chan struct{}),
+    }
+}
+
+func (s *Scheduler) Start() {
+    s.wg.Add(1)
+    s.running.Store(true)
+    go s.run()
+}
+
+// Running reports whether the scheduler was started and has not stopped since.
+func (s *Scheduler) Running() bool {
+    return s.running.Load()
+}
+
+func (s *Scheduler) run() {
+    defer s.wg.Done()
+    defer s.running.Store(false)
+    for {
+        s.job(s.clock.Now())
+        select {
+        case <-s.stop:
+            return
+        case <-s.clock.After(s.interval):
+        }
+    }
+}
+
+// Stop waits for a running job to finish, no further jobs are started afterwards.
+func (s *Scheduler) Stop() {
+    s.once.Do(func() {
+        close(s.stop)
+    })
+    s.wg.Wait()
+}
@@ -0,0 +1,653 @@
+package server
+
+import (
+    "bytes"
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/webhook"
+
+    "github.com/gorilla/mux"
+)
+
+const (
+    AssignmentJoined = "joined"
+    AssignmentLeft = "left"
+    AssignmentAssigned = "assigned"
+    AssignmentRemoved = "removed"
+    AssignmentMovedIn = "moved in"
+    AssignmentMovedOut = "moved out"
+)
+
+var ErrTaskFull = errors.New("Task has no free slots")
+var ErrAlreadyAssigned = errors.New("User is already assigned to this task")
+
+// JoinRuleError explains which of the story's participant rules prevents joining a task.
+type JoinRuleError struct {
+    Reason string
+}
+
+func (e *JoinRuleError) Error() string {
+    return e.Reason
+}
+
+type AssignmentLogEntry struct {
+    AssigneeName string
+    ActorName string
+    Action string
+    CreatedAt string
+}
+
+type TaskOption struct {
+    ID int64
+    Name string
+}
+
+// execer runs statements on the database or inside a transaction.
+type execer interface {
+    Exec(query string, args ...any) (sql.Result, error)
+}
+
+func recordAssignmentChange(db execer, taskID int64, assigneeID int64, actorID int64, action string) error {
+    _, err := db.Exec(
+        "INSERT INTO assignment_log (task_id, assignee_id, actor_id, action, created_at) VALUES($1, $2, $3, $4, $5)",
+        taskID, assigneeID, actorID, action, time.Now().Unix(),
+    )
+    return err
+}
+
+func GetAssignmentLog(db *sql.DB, taskID int64) ([]AssignmentLogEntry, error) {
+    entries := []AssignmentLogEntry{}
+    rows, err := db.Query(`
+        SELECT
+            assignee.username,
+            actor.username,
+            assignment_log.action,
+            assignment_log.created_at
+        FROM assignment_log
+        JOIN user AS assignee ON assignee.id = assignment_log.assignee_id
+        JOIN user AS actor ON actor.id = assignment_log.actor_id
+        WHERE assignment_log.task_id = $1
+        ORDER BY assignment_log.id DESC
+        LIMIT 5
+        `,
+        taskID,
+    )
+    if err != nil {
+        return []AssignmentLogEntry{}, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var entry AssignmentLogEntry
+        var createdAt int64
+        err = rows.Scan(&entry.AssigneeName, &entry.ActorName, &entry.Action, &createdAt)
+        if err != nil {
+            return []AssignmentLogEntry{}, err
+        }
+        entry.CreatedAt = time.Unix(createdAt, 0).Format("02. 01. 2006 15:04")
+        entries = append(entries, entry)
+    }
+    return entries, nil
+}
+
+func GetStoryTaskOptions(db *sql.DB, storyID int64) ([]TaskOption, error) {
+    options := []TaskOption{}
+    rows, err := db.Query("SELECT task.id, task.name FROM task WHERE task.story_id = $1 ORDER BY task.position, task.start_time IS NULL, task.start_time, task.id", storyID)
+    if err != nil {
+        return []TaskOption{}, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var option TaskOption
+        err = rows.Scan(&option.ID, &option.Name)
+        if err != nil {
+            return []TaskOption{}, err
+        }
+        options = append(options, option)
+    }
+    return options, nil
+}
+
+// fillOrganizerTaskData loads the parts of a task only organizers get to see.
+func fillOrganizerTaskData(db *sql.DB, task *Task, options []TaskOption) error {
+    history, err := GetAssignmentLog(db, task.ID)
+    if err != nil {
+        return err
+    }
+    task.History = history
+    task.MoveTargets = []TaskOption{}
+    for _, option := range options {
+        if option.ID != task.ID {
+            task.MoveTargets = append(task.MoveTargets, option)
+        }
+    }
+    return nil
+}
+
+func renderTaskElement(w http.ResponseWriter, r *http.Request, tasks ...Task) {
+    var buffer bytes.Buffer
+    for _, task := range tasks {
+        err := executeTemplate(&buffer, "task-view", "task-list-element-view.html", task)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error building template", err))
+            return
+        }
+    }
+    buffer.WriteTo(w)
+}
+
+func renderSingleTask(w http.ResponseWriter, r *http.Request, db *sql.DB, taskID int64, userID int64) {
+    task, err := GetSingleTask(db, taskID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    task.IsUserLoggedIn = true
+    renderTaskElement(w, r, task)
+}
+
+func isTaskLocked(db *sql.DB, taskID int64) (bool, error) {
+    row := db.QueryRow("SELECT locked FROM task WHERE id = $1", taskID)
+    var locked bool
+    err := row.Scan(&locked)
+    return locked, err
+}
+
+// joinTask assigns the user to the task. The capacity check and the insert run
+// as one statement, so concurrent joins cannot overfill the task, and the
+// unique (task_id, assignee_id) index rejects double joins. Self-service joins
+// also enforce the story's per-participant task limit, exclusive task groups
+// and refuse tasks overlapping in time with tasks the user already joined.
+func joinTask(db *sql.DB, taskID int64, assigneeID int64, enforceRules bool) error {
+    result, err := db.Exec(`
+        INSERT OR IGNORE INTO assignment (task_id, assignee_id, joined_at)
+        SELECT task.id, $2, $4
+        FROM task
+        JOIN story ON story.id = task.story_id
+        WHERE task.id = $1
+        AND (SELECT COUNT(*) FROM assignment WHERE assignment.task_id = task.id) < task.slots
+        AND (
+            $3 = 0
+            OR (
+                (
+                    COALESCE(story.max_no_shows, 0) = 0
+                    OR (
+                        SELECT COUNT(*)
+                        FROM attendance_record
+                        WHERE attendance_record.user_id = $2
+                        AND attendance_record.attendance = 2
+                    ) < story.max_no_shows
+                )
+                AND (
+                    COALESCE(story.max_tasks_per_user, 0) = 0
+                    OR (
+                        SELECT COUNT(*)
+                        FROM assignment
+                        JOIN task AS joined ON joined.id = assignment.task_id
+                        WHERE joined.story_id = story.id
+                        AND assignment.assignee_id = $2
+                    ) < story.max_tasks_per_user
+                )
+                AND (
+                    COALESCE(task.exclusive_group, '') = ''
+                    OR NOT EXISTS (
+                        SELECT 1
+                        FROM assignment
+                        JOIN task AS joined ON joined.id = assignment.task_id
+                        WHERE joined.story_id = story.id
+                        AND joined.exclusive_group = task.exclusive_group
+                        AND assignment.assignee_id = $2
+                    )
+                )
+                AND (
+                    task.start_time IS NULL
+                    OR task.end_time IS NULL
+                    OR NOT EXISTS (
+                        SELECT 1
+                        FROM assignment
+                        JOIN task AS joined ON joined.id = assignment.task_id
+                        WHERE assignment.assignee_id = $2
+                        AND joined.start_time < task.end_time
+                        AND joined.end_time > task.start_time
+                    )
+                )
+            )
+        )
+        `,
+        taskID,
+        assigneeID,
+        enforceRules,
+        time.Now().Unix(),
+    )
+    if err != nil {
+        return err
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rowsAffected == 1 {
+        return nil
+    }
+    return joinFailureReason(db, taskID, assigneeID, enforceRules)
+}
+
+// moveToTask moves an existing assignment to another task with the same
+// guarantees joinTask gives.
+func moveToTask(db *sql.DB, assignmentID int64, assigneeID int64, taskID int64) error {
+    result, err := db.Exec(`
+        UPDATE OR IGNORE assignment SET task_id = $1
+        WHERE id = $2
+        AND (SELECT COUNT(*) FROM assignment WHERE task_id = $1) < (SELECT slots FROM task WHERE id = $1)
+        `,
+        taskID,
+        assignmentID,
+    )
+    if err != nil {
+        return err
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rowsAffected == 1 {
+        return nil
+    }
+    return joinFailureReason(db, taskID, assigneeID, false)
+}
+
+// renderJoinConflict answers a failed self-service join with the current state
+// of the task and an explanation, so the requester sees why the join did not go through.
+func renderJoinConflict(w http.ResponseWriter, r *http.Request, db *sql.DB, taskID int64, userID int64, joinErr error) {
+    task, err := GetSingleTask(db, taskID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    task.IsUserLoggedIn = true
+    task.Notice = "Sorry, the last slot was just taken."
+    if joinErr == ErrAlreadyAssigned {
+        task.Notice = "You have already joined this task."
+    }
+    if ruleErr, ok := joinErr.(*JoinRuleError); ok {
+        task.Notice = ruleErr.Reason
+    }
+    w.WriteHeader(409)
+    renderTaskElement(w, r, task)
+}
+
+func joinFailureReason(db *sql.DB, taskID int64, assigneeID int64, enforceRules bool) error {
+    row := db.QueryRow("SELECT COUNT(*) FROM assignment WHERE task_id = $1 AND assignee_id = $2", taskID, assigneeID)
+    var existing int64
+    err := row.Scan(&existing)
+    if err != nil {
+        return err
+    }
+    if existing > 0 {
+        return ErrAlreadyAssigned
+    }
+    if enforceRules {
+        err = checkJoinRules(db, taskID, assigneeID)
+        if err != nil {
+            return err
+        }
+    }
+    return ErrTaskFull
+}
+
+// checkJoinRules returns a *JoinRuleError when the story's participant rules
+// keep the user from joining the task.
+func checkJoinRules(db *sql.DB, taskID int64, userID int64) error {
+    row := db.QueryRow(`
+        SELECT
+            COALESCE(story.max_no_shows, 0),
+            (
+                SELECT COUNT(*)
+                FROM attendance_record
+                WHERE attendance_record.user_id = $2
+                AND attendance_record.attendance = 2
+            ),
+            COALESCE(story.max_tasks_per_user, 0),
+            (
+                SELECT COUNT(*)
+                FROM assignment
+                JOIN task AS joined ON joined.id = assignment.task_id
+                WHERE joined.story_id = story.id
+                AND assignment.assignee_id = $2
+            ),
+            (
+                SELECT joined.name
+                FROM assignment
+                JOIN task AS joined ON joined.id = assignment.task_id
+                WHERE joined.story_id = story.id
+                AND COALESCE(task.exclusive_group, '') != ''
+                AND joined.exclusive_group = task.exclusive_group
+                AND joined.id != task.id
+                AND assignment.assignee_id = $2
+                LIMIT 1
+            ),
+            (
+                SELECT joined.name
+                FROM assignment
+                JOIN task AS joined ON joined.id = assignment.task_id
+                JOIN story AS joined_story ON joined_story.id = joined.story_id
+                WHERE assignment.assignee_id = $2
+                AND joined.id != task.id
+                AND joined.start_time < task.end_time
+                AND joined.end_time > task.start_time
+                LIMIT 1
+            )
+        FROM task
+        JOIN story ON story.id = task.story_id
+        WHERE task.id = $1
+        `,
+        taskID,
+        userID,
+    )
+    var maxNoShows int64
+    var noShows int64
+    var maxTasks int64
+    var joinedTasks int64
+    var exclusiveTaskOption sql.NullString
+    var overlappingTaskOption sql.NullString
+    err := row.Scan(&maxNoShows, &noShows, &maxTasks, &joinedTasks, &exclusiveTaskOption, &overlappingTaskOption)
+    if err != nil {
+        return err
+    }
+    if maxNoShows > 0 && noShows >= maxNoShows {
+        return &JoinRuleError{ Reason: fmt.Sprintf("You were marked as a no-show %d times, so this story does not accept your signups.", noShows) }
+    }
+    if overlappingTaskOption.Valid {
+        return &JoinRuleError{ Reason: fmt.Sprintf("This task overlaps with %s, which you already joined.", overlappingTaskOption.String) }
+    }
+    if exclusiveTaskOption.Valid {
+        return &JoinRuleError{ Reason: fmt.Sprintf("You already joined %s, which cannot be combined with this task.", exclusiveTaskOption.String) }
+    }
+    if maxTasks > 0 && joinedTasks >= maxTasks {
+        return &JoinRuleError{ Reason: fmt.Sprintf("You already joined the maximum of %d tasks in this story.", maxTasks) }
+    }
+    return nil
+}
+
+// joinBlockedReason explains why the join button is unavailable, or returns
+// an empty string when the user may join.
+func joinBlockedReason(db *sql.DB, task Task, userID int64) (string, error) {
+    if task.HasJoined || task.SlotsAssigned >= task.SlotsTotal {
+        return "", nil
+    }
+    err := checkJoinRules(db, task.ID, userID)
+    if ruleErr, ok := err.(*JoinRuleError); ok {
+        return ruleErr.Reason, nil
+    }
+    return "", err
+}
+
+type assignmentRecord struct {
+    ID int64
+    TaskID int64
+    AssigneeID int64
+}
+
+func getAssignment(db *sql.DB, assignmentID int64) (assignmentRecord, error) {
+    row := db.QueryRow("SELECT id, task_id, assignee_id FROM assignment WHERE id = $1", assignmentID)
+    var assignment assignmentRecord
+    err := row.Scan(&assignment.ID, &assignment.TaskID, &assignment.AssigneeID)
+    return assignment, err
+}
+
+// organizedAssignmentFromRequest resolves the assignment in the route and makes
+// sure the session user organizes the story it belongs to.
+func organizedAssignmentFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB) (assignmentRecord, int64, bool) {
+    vars := mux.Vars(r)
+    assignmentID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return assignmentRecord{}, 0, false
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return assignmentRecord{}, 0, false
+    }
+    assignment, err := getAssignment(db, assignmentID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Assignment no longer exists"))
+        return assignmentRecord{}, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting assignment", err))
+        return assignmentRecord{}, 0, false
+    }
+    storyID, err := GetTaskStoryID(db, assignment.TaskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return assignmentRecord{}, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return assignmentRecord{}, 0, false
+    }
+    isOrganizer, err := IsStoryOrganizer(db, storyID, userID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return assignmentRecord{}, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return assignmentRecord{}, 0, false
+    }
+    if !isOrganizer {
+        writeError(w, r, apperror.Forbidden("Only story organizers can do this"))
+        return assignmentRecord{}, 0, false
+    }
+    return assignment, userID, true
+}
+
+func AssignTaskUserHandler (w http.ResponseWriter, r *http.Request) {
+    username := r.PostFormValue("username")
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    taskID, userID, ok := organizedTaskFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    assigneeID, err := GetUserIDByName(db, username)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot find user %s", username)))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting user", err))
+        return
+    }
+
+    err = joinTask(db, taskID, assigneeID, false)
+    if err == ErrAlreadyAssigned {
+        writeError(w, r, apperror.Conflict(fmt.Sprintf("%s is already assigned to this task", username)))
+        return
+    }
+    if err == ErrTaskFull {
+        writeError(w, r, apperror.Conflict("Task has no free slots"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error changing task assignment", err))
+        return
+    }
+    err = recordAssignmentChange(db, taskID, assigneeID, userID, AssignmentAssigned)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error recording assignment change", err))
+        return
+    }
+    publishAssignmentEvent(db, webhook.AssignmentJoined, taskID, assigneeID, userID)
+
+    notifyTaskChanged(db, taskID)
+    renderSingleTask(w, r, db, taskID, userID)
+}
+
+func RemoveAssignmentHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    assignment, userID, ok := organizedAssignmentFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    _, err = db.Exec("DELETE FROM assignment WHERE id = $1", assignment.ID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error changing task assignment", err))
+        return
+    }
+    err = recordAssignmentChange(db, assignment.TaskID, assignment.AssigneeID, userID, AssignmentRemoved)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error recording assignment change", err))
+        return
+    }
+    publishAssignmentEvent(db, webhook.AssignmentLeft, assignment.TaskID, assignment.AssigneeID, userID)
+
+    taskName, storyTitle, _ := getTaskNames(db, assignment.TaskID)
+    storyID, _ := GetTaskStoryID(db, assignment.TaskID)
+    notifyUsers(db, NotificationAssignmentChanges, []int64{ assignment.AssigneeID }, userID, "assignment-removed", NotificationData{
+        StoryID: storyID,
+        ActorName: getUsername(db, userID),
+        StoryTitle: storyTitle,
+        TaskName: taskName,
+    })
+
+    notifyTaskChanged(db, assignment.TaskID)
+    renderSingleTask(w, r, db, assignment.TaskID, userID)
+}
+
+func MoveAssignmentHandler (w http.ResponseWriter, r *http.Request) {
+    targetTaskID, err := strconv.ParseInt(r.PostFormValue("task"), 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", r.PostFormValue("task"))))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    assignment, userID, ok := organizedAssignmentFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    if targetTaskID == assignment.TaskID {
+        renderSingleTask(w, r, db, assignment.TaskID, userID)
+        return
+    }
+
+    storyID, err := GetTaskStoryID(db, assignment.TaskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    targetStoryID, err := GetTaskStoryID(db, targetTaskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    if storyID != targetStoryID {
+        writeError(w, r, apperror.Validation("Participants can only be moved between tasks of the same story"))
+        return
+    }
+
+    err = moveToTask(db, assignment.ID, assignment.AssigneeID, targetTaskID)
+    if err == ErrAlreadyAssigned {
+        writeError(w, r, apperror.Conflict("Participant is already assigned to the target task"))
+        return
+    }
+    if err == ErrTaskFull {
+        writeError(w, r, apperror.Conflict("Target task has no free slots"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error changing task assignment", err))
+        return
+    }
+    err = recordAssignmentChange(db, assignment.TaskID, assignment.AssigneeID, userID, AssignmentMovedOut)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error recording assignment change", err))
+        return
+    }
+    err = recordAssignmentChange(db, targetTaskID, assignment.AssigneeID, userID, AssignmentMovedIn)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error recording assignment change", err))
+        return
+    }
+    publishAssignmentEvent(db, webhook.AssignmentLeft, assignment.TaskID, assignment.AssigneeID, userID)
+    publishAssignmentEvent(db, webhook.AssignmentJoined, targetTaskID, assignment.AssigneeID, userID)
+
+    source, err := GetSingleTask(db, assignment.TaskID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    target, err := GetSingleTask(db, targetTaskID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    _, storyTitle, _ := getTaskNames(db, assignment.TaskID)
+    notifyUsers(db, NotificationAssignmentChanges, []int64{ assignment.AssigneeID }, userID, "assignment-moved", NotificationData{
+        StoryID: storyID,
+        ActorName: getUsername(db, userID),
+        StoryTitle: storyTitle,
+        TaskName: source.Name,
+        TargetTaskName: target.Name,
+    })
+    source.IsUserLoggedIn = true
+    target.IsUserLoggedIn = true
+    target.SwapOOB = true
+    notifyTaskChanged(db, assignment.TaskID)
+    notifyTaskChanged(db, targetTaskID)
+    renderTaskElement(w, r, source, target)
+}
+
+func ChangeTaskLockHandler (w http.ResponseWriter, r *http.Request) {
+    locked := r.PostFormValue("locked") == "1"
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    taskID, userID, ok := organizedTaskFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    _, err = db.Exec("UPDATE task SET locked = $1 WHERE id = $2", locked, taskID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating task data", err))
+        return
+    }
+
+    notifyTaskChanged(db, taskID)
+    renderSingleTask(w, r, db, taskID, userID)
+}
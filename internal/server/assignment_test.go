@@ -0,0 +1,62 @@
+package server
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+)
+
+func TestJoinTaskConcurrently(t *testing.T) {
+    db := openTestDB(t)
+    const slots = 4
+    const users = 10
+    organizerID := createTestUser(t, db, "organizer")
+    storyID := mustExec(t, db, "INSERT INTO story (title, creator_id, status) VALUES('Story', $1, 1)", organizerID)
+    taskID := mustExec(t, db, "INSERT INTO task (story_id, name, slots) VALUES($1, 'Task', $2)", storyID, slots)
+    userIDs := []int64{}
+    for i := 0; i < users; i++ {
+        userIDs = append(userIDs, createTestUser(t, db, fmt.Sprintf("user%d", i)))
+    }
+
+    // every user tries to join twice at the same time
+    var wg sync.WaitGroup
+    results := make(chan error, 2 * users)
+    start := make(chan struct{})
+    for _, userID := range append(userIDs, userIDs...) {
+        wg.Add(1)
+        go func(userID int64) {
+            defer wg.Done()
+            <-start
+            results <- joinTask(db, taskID, userID, true)
+        }(userID)
+    }
+    close(start)
+    wg.Wait()
+    close(results)
+
+    joined := 0
+    for err := range results {
+        switch err {
+        case nil:
+            joined++
+        case ErrTaskFull, ErrAlreadyAssigned:
+        default:
+            t.Errorf("unexpected error joining: %v", err)
+        }
+    }
+    if joined != slots {
+        t.Errorf("%d joins succeeded, want %d", joined, slots)
+    }
+
+    var assignments, assignees int
+    err := db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT assignee_id) FROM assignment WHERE task_id = $1", taskID).Scan(&assignments, &assignees)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if assignments != slots {
+        t.Errorf("task has %d assignments, want %d", assignments, slots)
+    }
+    if assignees != assignments {
+        t.Errorf("task has %d assignments for %d users, want no duplicates", assignments, assignees)
+    }
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+    "bytes"
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+    "zmtwc/sk/internal/apperror"
+)
+
+const (
+    AttendanceUnknown int64 = 0
+    AttendanceAttended int64 = 1
+    AttendanceNoShow int64 = 2
+)
+
+type AttendanceStats struct {
+    Attended int64
+    NoShows int64
+}
+
+type CheckInEntry struct {
+    AssignmentID int64
+    TaskName string
+    TimeWindow string
+    AssigneeName string
+    Attendance int64
+    CheckedInAt string
+    Stats AttendanceStats
+}
+
+type CheckInPageData struct {
+    SwapOOB bool
+    StoryID int64
+    StoryTitle string
+    Attended int64
+    NoShows int64
+    Pending int64
+    Entries []CheckInEntry
+}
+
+func ParseAttendance(value string) (int64, error) {
+    attendance, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+        return 0, err
+    }
+    if attendance < AttendanceUnknown || attendance > AttendanceNoShow {
+        return 0, fmt.Errorf("Unknown attendance %d", attendance)
+    }
+    return attendance, nil
+}
+
+func GetUserAttendanceStats(db *sql.DB, userID int64) (AttendanceStats, error) {
+    row := db.QueryRow(`
+        SELECT
+            COALESCE(SUM(attendance = $2), 0),
+            COALESCE(SUM(attendance = $3), 0)
+        FROM attendance_record
+        WHERE user_id = $1
+        `,
+        userID,
+        AttendanceAttended,
+        AttendanceNoShow,
+    )
+    var stats AttendanceStats
+    err := row.Scan(&stats.Attended, &stats.NoShows)
+    return stats, err
+}
+
+func getCheckInEntries(db *sql.DB, storyID int64) ([]CheckInEntry, error) {
+    entries := []CheckInEntry{}
+    rows, err := db.Query(`
+        SELECT
+            assignment.id,
+            assignment.assignee_id,
+            attendance_record.attendance,
+            attendance_record.recorded_at,
+            user.username,
+            task.name,
+            task.start_time,
+            task.end_time
+        FROM assignment
+        JOIN task ON task.id = assignment.task_id
+        JOIN user ON user.id = assignment.assignee_id
+        LEFT JOIN attendance_record ON attendance_record.task_id = assignment.task_id AND attendance_record.user_id = assignment.assignee_id
+        WHERE task.story_id = $1
+        ORDER BY task.position, task.start_time IS NULL, task.start_time, task.id, user.username
+        `,
+        storyID,
+    )
+    if err != nil {
+        return []CheckInEntry{}, err
+    }
+    defer rows.Close()
+
+    assigneeIDs := []int64{}
+    for rows.Next() {
+        var entry CheckInEntry
+        var assigneeID int64
+        var attendanceOption sql.NullInt64
+        var recordedAtOption sql.NullInt64
+        var startTimeOption sql.NullInt64
+        var endTimeOption sql.NullInt64
+        err = rows.Scan(&entry.AssignmentID, &assigneeID, &attendanceOption, &recordedAtOption, &entry.AssigneeName, &entry.TaskName, &startTimeOption, &endTimeOption)
+        if err != nil {
+            return []CheckInEntry{}, err
+        }
+        entry.Attendance = attendanceOption.Int64
+        if entry.Attendance == AttendanceAttended {
+            entry.CheckedInAt = formatOptionalTime(recordedAtOption, "15:04")
+        }
+        entry.TimeWindow = formatTimeWindow(startTimeOption, endTimeOption)
+        entries = append(entries, entry)
+        assigneeIDs = append(assigneeIDs, assigneeID)
+    }
+    rows.Close()
+
+    for i := range entries {
+        entries[i].Stats, err = GetUserAttendanceStats(db, assigneeIDs[i])
+        if err != nil {
+            return []CheckInEntry{}, err
+        }
+    }
+    return entries, nil
+}
+
+func GetStoryCheckIn(db *sql.DB, storyID int64) (CheckInPageData, error) {
+    row := db.QueryRow("SELECT title FROM story WHERE id = $1", storyID)
+    var title string
+    err := row.Scan(&title)
+    if err != nil {
+        return CheckInPageData{}, err
+    }
+    entries, err := getCheckInEntries(db, storyID)
+    if err != nil {
+        return CheckInPageData{}, err
+    }
+
+    data := CheckInPageData{ StoryID: storyID, StoryTitle: title, Entries: entries }
+    for _, entry := range entries {
+        switch entry.Attendance {
+        case AttendanceAttended:
+            data.Attended++
+        case AttendanceNoShow:
+            data.NoShows++
+        default:
+            data.Pending++
+        }
+    }
+    return data, nil
+}
+
+// setAttendance records the attendance of the assignee at the task. It is
+// kept apart from the assignment, so the no-show limit still counts it after
+// the user left the task or the task was deleted, and the mark is back when
+// the user joins the task again.
+func setAttendance(db *sql.DB, storyID int64, assignment assignmentRecord, attendance int64) error {
+    var err error
+    if attendance == AttendanceUnknown {
+        _, err = db.Exec("DELETE FROM attendance_record WHERE task_id = $1 AND user_id = $2", assignment.TaskID, assignment.AssigneeID)
+    } else {
+        _, err = db.Exec(`
+            INSERT INTO attendance_record (task_id, user_id, story_id, attendance, recorded_at)
+            VALUES($1, $2, $3, $4, $5)
+            ON CONFLICT (task_id, user_id) DO UPDATE SET attendance = excluded.attendance, recorded_at = excluded.recorded_at
+            `,
+            assignment.TaskID, assignment.AssigneeID, storyID, attendance, time.Now().Unix(),
+        )
+    }
+    return err
+}
+
+func StoryCheckInHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    data, err := GetStoryCheckIn(db, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story attendance", err))
+        return
+    }
+
+    renderTemplate(w, r, "story-checkin", "story-checkin.html", data)
+}
+
+func ChangeAttendanceHandler (w http.ResponseWriter, r *http.Request) {
+    attendance, err := ParseAttendance(r.PostFormValue("attendance"))
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as attendance", r.PostFormValue("attendance"))))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    assignment, _, ok := organizedAssignmentFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    storyID, err := GetTaskStoryID(db, assignment.TaskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    err = setAttendance(db, storyID, assignment, attendance)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating attendance", err))
+        return
+    }
+    data, err := GetStoryCheckIn(db, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story attendance", err))
+        return
+    }
+    data.SwapOOB = true
+
+    var buffer bytes.Buffer
+    for _, entry := range data.Entries {
+        if entry.AssignmentID != assignment.ID {
+            continue
+        }
+        err = executeTemplate(&buffer, "story-checkin", "checkin-row", entry)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error building template", err))
+            return
+        }
+    }
+    err = executeTemplate(&buffer, "story-checkin", "checkin-summary", data)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error building template", err))
+        return
+    }
+    buffer.WriteTo(w)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+    "testing"
+)
+
+func TestCheckInShowsAttendanceAfterRejoin(t *testing.T) {
+    db := openTestDB(t)
+    organizerID := createTestUser(t, db, "organizer")
+    userID := createTestUser(t, db, "user")
+    storyID := mustExec(t, db, "INSERT INTO story (title, creator_id, status) VALUES('Story', $1, 1)", organizerID)
+    taskID := mustExec(t, db, "INSERT INTO task (story_id, name, slots) VALUES($1, 'Task', 2)", storyID)
+    assignmentID := mustExec(t, db, "INSERT INTO assignment (task_id, assignee_id) VALUES($1, $2)", taskID, userID)
+
+    err := setAttendance(db, storyID, assignmentRecord{ ID: assignmentID, TaskID: taskID, AssigneeID: userID }, AttendanceNoShow)
+    if err != nil {
+        t.Fatal(err)
+    }
+    mustExec(t, db, "DELETE FROM assignment WHERE id = $1", assignmentID)
+    err = joinTask(db, taskID, userID, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    data, err := GetStoryCheckIn(db, storyID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(data.Entries) != 1 {
+        t.Fatalf("got %d check-in entries, want 1", len(data.Entries))
+    }
+    entry := data.Entries[0]
+    if entry.Attendance != AttendanceNoShow || entry.Stats.NoShows != 1 || data.NoShows != 1 {
+        t.Errorf("got attendance %d with %d no-shows, %d on the page, want the no-show shown once", entry.Attendance, entry.Stats.NoShows, data.NoShows)
+    }
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+    "log/slog"
+    "path/filepath"
+    "time"
+    "zmtwc/sk/internal/backup"
+    "zmtwc/sk/internal/scheduler"
+)
+
+// BackupDir is where backups go unless a file is named explicitly.
+func BackupDir() string {
+    return settings.BackupDir
+}
+
+// StartBackups writes a backup to BackupDir every backup interval and keeps
+// the configured number of them. It returns nil when the interval is zero.
+func StartBackups(clock scheduler.Clock) *scheduler.Scheduler {
+    if settings.BackupInterval == 0 {
+        return nil
+    }
+    dir := settings.BackupDir
+    keep := settings.BackupKeep
+
+    backups := scheduler.New(clock, settings.BackupInterval, func(now time.Time) {
+        db, err := OpenDB()
+        if err != nil {
+            slog.Error("Error connecting to database", "error", err)
+            return
+        }
+
+        path := filepath.Join(dir, backup.FileName(now))
+        err = backup.Backup(db, path)
+        if err != nil {
+            slog.Error("Error writing backup", "path", path, "error", err)
+            return
+        }
+        err = backup.Rotate(dir, keep)
+        if err != nil {
+            slog.Error("Error removing old backups", "error", err)
+        }
+    })
+    backups.Start()
+    watchWorker("backups", backups.Running)
+    return backups
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/ical"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+)
+
+const defaultEventDuration = time.Hour
+
+type CalendarPageData struct {
+    FeedURL string
+}
+
+type joinedTaskRow struct {
+    StoryID int64
+    StoryTitle string
+    StoryDescription string
+    StoryStart sql.NullInt64
+    StoryEnd sql.NullInt64
+    TaskID int64
+    TaskName string
+    TaskDescription string
+    TaskStart sql.NullInt64
+    TaskEnd sql.NullInt64
+}
+
+func eventTimes(start int64, end sql.NullInt64) (time.Time, time.Time) {
+    startTime := time.Unix(start, 0)
+    if end.Valid {
+        return startTime, time.Unix(end.Int64, 0)
+    }
+    return startTime, startTime.Add(defaultEventDuration)
+}
+
+// getJoinedTasks lists the tasks the user joined, limited to one story when storyID is not 0.
+func getJoinedTasks(db *sql.DB, userID int64, storyID int64) ([]joinedTaskRow, error) {
+    rows, err := db.Query(`
+        SELECT
+            story.id,
+            story.title,
+            story.description,
+            story.start_time,
+            story.end_time,
+            task.id,
+            task.name,
+            task.description,
+            task.start_time,
+            task.end_time
+        FROM assignment
+        JOIN task ON task.id = assignment.task_id
+        JOIN story ON story.id = task.story_id
+        WHERE assignment.assignee_id = $1
+        AND ($2 = 0 OR story.id = $2)
+        ORDER BY story.start_time, story.id, task.position, task.start_time IS NULL, task.start_time, task.id
+        `,
+        userID,
+        storyID,
+    )
+    if err != nil {
+        return []joinedTaskRow{}, err
+    }
+    defer rows.Close()
+
+    joined := []joinedTaskRow{}
+    for rows.Next() {
+        var row joinedTaskRow
+        var storyTitleOption sql.NullString
+        var storyDescriptionOption sql.NullString
+        var taskDescriptionOption sql.NullString
+        err = rows.Scan(
+            &row.StoryID, &storyTitleOption, &storyDescriptionOption, &row.StoryStart, &row.StoryEnd,
+            &row.TaskID, &row.TaskName, &taskDescriptionOption, &row.TaskStart, &row.TaskEnd,
+        )
+        if err != nil {
+            return []joinedTaskRow{}, err
+        }
+        row.StoryTitle = storyTitleOption.String
+        row.StoryDescription = storyDescriptionOption.String
+        row.TaskDescription = taskDescriptionOption.String
+        joined = append(joined, row)
+    }
+    return joined, nil
+}
+
+// joinedTaskEvents turns joined tasks into one event per story, listing the
+// joined tasks, plus one event for every task with its own time window.
+func joinedTaskEvents(joined []joinedTaskRow) []ical.Event {
+    events := []ical.Event{}
+    storyEvents := map[int64]int{}
+    for _, row := range joined {
+        i, ok := storyEvents[row.StoryID]
+        if !ok && row.StoryStart.Valid {
+            start, end := eventTimes(row.StoryStart.Int64, row.StoryEnd)
+            i = len(events)
+            storyEvents[row.StoryID] = i
+            events = append(events, ical.Event{
+                UID: ical.EventUID("story", row.StoryID),
+                Summary: row.StoryTitle,
+                Description: strings.TrimSpace(row.StoryDescription + "\n\nYour tasks:"),
+                Start: start,
+                End: end,
+            })
+            ok = true
+        }
+        if ok {
+            events[i].Description += "\n- " + row.TaskName
+        }
+
+        if row.TaskStart.Valid {
+            start, end := eventTimes(row.TaskStart.Int64, row.TaskEnd)
+            events = append(events, ical.Event{
+                UID: ical.EventUID("task", row.TaskID),
+                Summary: fmt.Sprintf("%s: %s", row.StoryTitle, row.TaskName),
+                Description: row.TaskDescription,
+                Start: start,
+                End: end,
+            })
+        }
+    }
+    return events
+}
+
+func writeCalendar(w http.ResponseWriter, r *http.Request, filename string, calendar ical.Calendar) {
+    w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+    if filename != "" {
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+    }
+    err := ical.Write(w, calendar)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error building calendar", err))
+    }
+}
+
+func StoryCalendarHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, _ := auth.ValidateSession(db, r);
+    canView, err := CanViewStory(db, storyID, userID, r.URL.Query().Get("key"))
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+
+    row := db.QueryRow("SELECT title, description, start_time, end_time FROM story WHERE id = $1", storyID)
+    var titleOption sql.NullString
+    var descriptionOption sql.NullString
+    var startOption sql.NullInt64
+    var endOption sql.NullInt64
+    err = row.Scan(&titleOption, &descriptionOption, &startOption, &endOption)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !startOption.Valid {
+        writeError(w, r, apperror.NotFound("Story has no time set yet"))
+        return
+    }
+    joined, err := getJoinedTasks(db, userID, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting joined tasks", err))
+        return
+    }
+
+    events := joinedTaskEvents(joined)
+    if len(joined) == 0 {
+        start, end := eventTimes(startOption.Int64, endOption)
+        events = append(events, ical.Event{
+            UID: ical.EventUID("story", storyID),
+            Summary: titleOption.String,
+            Description: descriptionOption.String,
+            Start: start,
+            End: end,
+        })
+    }
+    writeCalendar(w, r, fmt.Sprintf("story-%d.ics", storyID), ical.Calendar{
+        Name: titleOption.String,
+        Events: events,
+    })
+}
+
+func CalendarFeedHandler (w http.ResponseWriter, r *http.Request) {
+    token := strings.TrimSuffix(mux.Vars(r)["token"], ".ics")
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    row := db.QueryRow("SELECT id, username FROM user WHERE calendar_token = $1 AND COALESCE(disabled, 0) = 0", token)
+    var userID int64
+    var username string
+    err = row.Scan(&userID, &username)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Calendar feed not found"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting user", err))
+        return
+    }
+    joined, err := getJoinedTasks(db, userID, 0)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting joined tasks", err))
+        return
+    }
+
+    writeCalendar(w, r, "", ical.Calendar{
+        Name: fmt.Sprintf("Tasks of %s", username),
+        Events: joinedTaskEvents(joined),
+    })
+}
+
+func calendarFeedURL(r *http.Request, token string) string {
+    scheme := "http"
+    if r.TLS != nil {
+        scheme = "https"
+    }
+    return fmt.Sprintf("%s://%s/calendar/%s.ics", scheme, r.Host, token)
+}
+
+func renderCalendarPage(w http.ResponseWriter, r *http.Request, token string) {
+    renderTemplate(w, r, "calendar", "calendar.html", CalendarPageData{ FeedURL: calendarFeedURL(r, token) })
+}
+
+func CalendarPageHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+
+    row := db.QueryRow("SELECT calendar_token FROM user WHERE id = $1", userID)
+    var tokenOption sql.NullString
+    err = row.Scan(&tokenOption)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting user", err))
+        return
+    }
+    token := tokenOption.String
+    if !tokenOption.Valid {
+        token = uuid.New().String()
+        _, err = db.Exec("UPDATE user SET calendar_token = $1 WHERE id = $2", token, userID)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error creating calendar feed", err))
+            return
+        }
+    }
+    renderCalendarPage(w, r, token)
+}
+
+func ResetCalendarTokenHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+
+    token := uuid.New().String()
+    _, err = db.Exec("UPDATE user SET calendar_token = $1 WHERE id = $2", token, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error resetting calendar feed", err))
+        return
+    }
+    renderCalendarPage(w, r, token)
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "html/template"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/markup"
+
+    "github.com/gorilla/mux"
+)
+
+type Comment struct {
+    ID int64
+    StoryID int64
+    TaskID int64
+    AuthorName string
+    Body string
+    HTML template.HTML
+    CreatedAt string
+    IsEdited bool
+    CanEdit bool
+    CanDelete bool
+}
+
+type CommentThread struct {
+    StoryID int64
+    TaskID int64
+    IsUserLoggedIn bool
+    Comments []Comment
+}
+
+type commentRecord struct {
+    ID int64
+    StoryID int64
+    TaskID int64
+    AuthorID int64
+}
+
+func scanComment(scanner interface{ Scan(...any) error }, userID int64, isStoryOrganizer bool) (Comment, error) {
+    var comment Comment
+    var taskOption sql.NullInt64
+    var authorID int64
+    var createdAt int64
+    var editedOption sql.NullInt64
+    err := scanner.Scan(&comment.ID, &comment.StoryID, &taskOption, &authorID, &comment.AuthorName, &comment.Body, &createdAt, &editedOption)
+    if err != nil {
+        return Comment{}, err
+    }
+    comment.TaskID = taskOption.Int64
+    comment.HTML = markup.Render(comment.Body)
+    comment.CreatedAt = time.Unix(createdAt, 0).Format(DisplayTimeFormat)
+    comment.IsEdited = editedOption.Valid
+    comment.CanEdit = userID != 0 && authorID == userID
+    comment.CanDelete = comment.CanEdit || isStoryOrganizer
+    return comment, nil
+}
+
+const commentColumns = `
+    comment.id,
+    comment.story_id,
+    comment.task_id,
+    comment.author_id,
+    user.username,
+    comment.body,
+    comment.created_at,
+    comment.edited_at
+`
+
+// GetCommentThread loads the comments of a story, or of one of its tasks when taskID is not 0.
+func GetCommentThread(db *sql.DB, storyID int64, taskID int64, userID int64, isUserLoggedIn bool) (CommentThread, error) {
+    isStoryOrganizer := false
+    if isUserLoggedIn {
+        var err error
+        isStoryOrganizer, err = IsStoryOrganizer(db, storyID, userID)
+        if err != nil {
+            return CommentThread{}, err
+        }
+    }
+
+    rows, err := db.Query(`
+        SELECT `+commentColumns+`
+        FROM comment
+        JOIN user ON user.id = comment.author_id
+        WHERE comment.story_id = $1
+        AND COALESCE(comment.task_id, 0) = $2
+        ORDER BY comment.id
+        `,
+        storyID,
+        taskID,
+    )
+    if err != nil {
+        return CommentThread{}, err
+    }
+    defer rows.Close()
+
+    comments := []Comment{}
+    for rows.Next() {
+        comment, err := scanComment(rows, userID, isStoryOrganizer)
+        if err != nil {
+            return CommentThread{}, err
+        }
+        comments = append(comments, comment)
+    }
+    return CommentThread{
+        StoryID: storyID,
+        TaskID: taskID,
+        IsUserLoggedIn: isUserLoggedIn,
+        Comments: comments,
+    }, nil
+}
+
+func getSingleComment(db *sql.DB, commentID int64, userID int64, isStoryOrganizer bool) (Comment, error) {
+    row := db.QueryRow(`
+        SELECT `+commentColumns+`
+        FROM comment
+        JOIN user ON user.id = comment.author_id
+        WHERE comment.id = $1
+        `,
+        commentID,
+    )
+    return scanComment(row, userID, isStoryOrganizer)
+}
+
+func renderCommentThread(w http.ResponseWriter, r *http.Request, db *sql.DB, storyID int64, taskID int64, userID int64, isUserLoggedIn bool) {
+    thread, err := GetCommentThread(db, storyID, taskID, userID, isUserLoggedIn)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting comments", err))
+        return
+    }
+    renderTemplate(w, r, "comments", "comment-thread", thread)
+}
+
+func renderComment(w http.ResponseWriter, r *http.Request, templateName string, comment Comment) {
+    renderTemplate(w, r, "comments", templateName, comment)
+}
+
+// commentFromRequest resolves the comment in the route for the session user,
+// who has to be able to see its story, and reports whether they organize it.
+func commentFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB) (commentRecord, int64, bool, bool) {
+    vars := mux.Vars(r)
+    commentID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return commentRecord{}, 0, false, false
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return commentRecord{}, 0, false, false
+    }
+
+    row := db.QueryRow("SELECT id, story_id, COALESCE(task_id, 0), author_id FROM comment WHERE id = $1", commentID)
+    var comment commentRecord
+    err = row.Scan(&comment.ID, &comment.StoryID, &comment.TaskID, &comment.AuthorID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Comment no longer exists"))
+        return commentRecord{}, 0, false, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting comment", err))
+        return commentRecord{}, 0, false, false
+    }
+    canView, err := CanViewStory(db, comment.StoryID, userID, r.URL.Query().Get("key"))
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return commentRecord{}, 0, false, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return commentRecord{}, 0, false, false
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return commentRecord{}, 0, false, false
+    }
+    isOrganizer, err := IsStoryOrganizer(db, comment.StoryID, userID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return commentRecord{}, 0, false, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return commentRecord{}, 0, false, false
+    }
+    return comment, userID, isOrganizer, true
+}
+
+func CommentThreadHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    taskID := int64(0)
+    if r.URL.Query().Get("task") != "" {
+        taskID, err = strconv.ParseInt(r.URL.Query().Get("task"), 10, 64)
+        if err != nil {
+            writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", r.URL.Query().Get("task"))))
+            return
+        }
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, sessionErr := auth.ValidateSession(db, r);
+    canView, err := CanViewStory(db, storyID, userID, r.URL.Query().Get("key"))
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+    renderCommentThread(w, r, db, storyID, taskID, userID, sessionErr == nil)
+}
+
+func CreateCommentHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    body := strings.TrimSpace(r.PostFormValue("body"))
+    if body == "" {
+        writeError(w, r, apperror.Validation("Comment cannot be empty"))
+        return
+    }
+    taskOption := sql.NullInt64{}
+    if r.PostFormValue("task") != "" && r.PostFormValue("task") != "0" {
+        taskID, err := strconv.ParseInt(r.PostFormValue("task"), 10, 64)
+        if err != nil {
+            writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", r.PostFormValue("task"))))
+            return
+        }
+        taskOption = sql.NullInt64{ Int64: taskID, Valid: true }
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+    canView, err := CanViewStory(db, storyID, userID, "")
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+    if taskOption.Valid {
+        taskStoryID, err := GetTaskStoryID(db, taskOption.Int64)
+        if err == sql.ErrNoRows {
+            writeError(w, r, apperror.NotFound("Task no longer exists"))
+            return
+        }
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error getting task data", err))
+            return
+        }
+        if taskStoryID != storyID {
+            writeError(w, r, apperror.Validation("Task does not belong to this story"))
+            return
+        }
+    }
+
+    _, err = db.Exec(
+        "INSERT INTO comment (story_id, task_id, author_id, body, created_at) VALUES($1, $2, $3, $4, $5)",
+        storyID, taskOption, userID, body, time.Now().Unix(),
+    )
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating comment", err))
+        return
+    }
+    renderCommentThread(w, r, db, storyID, taskOption.Int64, userID, true)
+}
+
+func CommentHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    record, userID, isOrganizer, ok := commentFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    comment, err := getSingleComment(db, record.ID, userID, isOrganizer)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting comment", err))
+        return
+    }
+    renderComment(w, r, "comment", comment)
+}
+
+func CommentEditViewHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    record, userID, isOrganizer, ok := commentFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    if record.AuthorID != userID {
+        writeError(w, r, apperror.Forbidden("Only the author can edit this comment"))
+        return
+    }
+    comment, err := getSingleComment(db, record.ID, userID, isOrganizer)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting comment", err))
+        return
+    }
+    renderComment(w, r, "comment-edit", comment)
+}
+
+func ChangeCommentHandler (w http.ResponseWriter, r *http.Request) {
+    body := strings.TrimSpace(r.PostFormValue("body"))
+    if body == "" {
+        writeError(w, r, apperror.Validation("Comment cannot be empty"))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    record, userID, isOrganizer, ok := commentFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    if record.AuthorID != userID {
+        writeError(w, r, apperror.Forbidden("Only the author can edit this comment"))
+        return
+    }
+
+    _, err = db.Exec("UPDATE comment SET body = $1, edited_at = $2 WHERE id = $3", body, time.Now().Unix(), record.ID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating comment", err))
+        return
+    }
+    comment, err := getSingleComment(db, record.ID, userID, isOrganizer)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting comment", err))
+        return
+    }
+    renderComment(w, r, "comment", comment)
+}
+
+func DeleteCommentHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    record, userID, isOrganizer, ok := commentFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    if record.AuthorID != userID && !isOrganizer {
+        writeError(w, r, apperror.Forbidden("Only the author or story organizers can delete this comment"))
+        return
+    }
+
+    _, err = db.Exec("DELETE FROM comment WHERE id = $1", record.ID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting comment", err))
+        return
+    }
+}
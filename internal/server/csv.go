@@ -0,0 +1,337 @@
+package server
+
+import (
+    "database/sql"
+    "encoding/csv"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/webhook"
+)
+
+const maxImportRows = 500
+
+const csvTimeFormat = "2006-01-02 15:04"
+
+var importColumns = []string{ "name", "description", "slots", "section", "group", "start", "end" }
+
+type exportSignup struct {
+    Username string
+    JoinedAt sql.NullInt64
+}
+
+type exportTask struct {
+    ID int64
+    Name string
+    Section string
+    Slots int64
+    Signups []exportSignup
+}
+
+type importedTask struct {
+    Name string
+    Description string
+    Slots int64
+    Section string
+    Group string
+    Start sql.NullInt64
+    End sql.NullInt64
+}
+
+type TaskImportData struct {
+    Errors []string
+    Tasks []Task
+}
+
+func getExportTasks(db *sql.DB, storyID int64) ([]exportTask, error) {
+    rows, err := db.Query(`
+        SELECT task.id, task.name, task.section, task.slots, user.username, assignment.joined_at
+        FROM task
+        LEFT JOIN assignment ON assignment.task_id = task.id
+        LEFT JOIN user ON user.id = assignment.assignee_id
+        WHERE task.story_id = $1
+        ORDER BY task.position, task.start_time IS NULL, task.start_time, task.id, assignment.id
+        `,
+        storyID,
+    )
+    if err != nil {
+        return []exportTask{}, err
+    }
+    defer rows.Close()
+
+    tasks := []exportTask{}
+    for rows.Next() {
+        var task exportTask
+        var sectionOption sql.NullString
+        var usernameOption sql.NullString
+        var joinedAt sql.NullInt64
+        err = rows.Scan(&task.ID, &task.Name, &sectionOption, &task.Slots, &usernameOption, &joinedAt)
+        if err != nil {
+            return []exportTask{}, err
+        }
+        if len(tasks) == 0 || tasks[len(tasks) - 1].ID != task.ID {
+            task.Section = sectionOption.String
+            tasks = append(tasks, task)
+        }
+        if usernameOption.Valid {
+            last := &tasks[len(tasks) - 1]
+            last.Signups = append(last.Signups, exportSignup{ Username: usernameOption.String, JoinedAt: joinedAt })
+        }
+    }
+    return tasks, nil
+}
+
+// csvCell keeps spreadsheets from running user-entered text as a formula by
+// prefixing cells that start like one with an apostrophe.
+func csvCell(value string) string {
+    if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+        return "'" + value
+    }
+    return value
+}
+
+// StoryExportHandler writes one row per task slot, leaving the assignee empty for free slots.
+func StoryExportHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    tasks, err := getExportTasks(db, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story tasks", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"story-%d.csv\"", storyID))
+    writer := csv.NewWriter(w)
+    writer.Write([]string{ "task", "section", "slot", "assignee", "joined_at" })
+    for _, task := range tasks {
+        slots := task.Slots
+        if int64(len(task.Signups)) > slots {
+            slots = int64(len(task.Signups))
+        }
+        for slot := int64(0); slot < slots; slot++ {
+            assignee := ""
+            joinedAt := ""
+            if slot < int64(len(task.Signups)) {
+                assignee = task.Signups[slot].Username
+                joinedAt = formatOptionalTime(task.Signups[slot].JoinedAt, csvTimeFormat)
+            }
+            writer.Write([]string{ csvCell(task.Name), csvCell(task.Section), strconv.FormatInt(slot + 1, 10), csvCell(assignee), joinedAt })
+        }
+    }
+    writer.Flush()
+}
+
+func parseImportTime(value string) (sql.NullInt64, error) {
+    value = strings.TrimSpace(value)
+    if value == "" {
+        return sql.NullInt64{}, nil
+    }
+    for _, layout := range []string{ csvTimeFormat, InputTimeFormat } {
+        parsed, err := time.ParseInLocation(layout, value, time.Local)
+        if err == nil {
+            return sql.NullInt64{ Int64: parsed.Unix(), Valid: true }, nil
+        }
+    }
+    return sql.NullInt64{}, fmt.Errorf("%s is not a time like %s", value, csvTimeFormat)
+}
+
+// parseTaskImport reads and validates every row, returning either the tasks
+// or the problems found, numbered by spreadsheet row with the header being row 1.
+func parseTaskImport(db *sql.DB, storyID int64, input io.Reader) ([]importedTask, []string, error) {
+    reader := csv.NewReader(input)
+    reader.TrimLeadingSpace = true
+    records, err := reader.ReadAll()
+    if err != nil {
+        return []importedTask{}, []string{ fmt.Sprintf("Cannot read the file as CSV: %s", err) }, nil
+    }
+    if len(records) < 2 {
+        return []importedTask{}, []string{ "The file needs a header row and at least one task" }, nil
+    }
+    if len(records) - 1 > maxImportRows {
+        return []importedTask{}, []string{ fmt.Sprintf("At most %d tasks can be imported at once", maxImportRows) }, nil
+    }
+
+    columns := map[string]int{}
+    problems := []string{}
+    for i, name := range records[0] {
+        name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+        known := false
+        for _, column := range importColumns {
+            known = known || column == name
+        }
+        if !known {
+            problems = append(problems, fmt.Sprintf("Unknown column %s, expected some of %s", name, strings.Join(importColumns, ", ")))
+        }
+        columns[name] = i
+    }
+    for _, required := range []string{ "name", "slots" } {
+        if _, ok := columns[required]; !ok {
+            problems = append(problems, fmt.Sprintf("Column %s is missing", required))
+        }
+    }
+    if len(problems) > 0 {
+        return []importedTask{}, problems, nil
+    }
+
+    tasks := []importedTask{}
+    for i, record := range records[1:] {
+        value := func(column string) string {
+            index, ok := columns[column]
+            if !ok {
+                return ""
+            }
+            return strings.TrimSpace(record[index])
+        }
+        rowProblems := []string{}
+        task := importedTask{
+            Name: value("name"),
+            Description: value("description"),
+            Section: value("section"),
+            Group: value("group"),
+        }
+        if task.Name == "" {
+            rowProblems = append(rowProblems, "name is empty")
+        }
+        task.Slots, err = strconv.ParseInt(value("slots"), 10, 64)
+        if err != nil || task.Slots < 1 {
+            rowProblems = append(rowProblems, fmt.Sprintf("slots %s is not a positive number", value("slots")))
+        }
+        task.Start, err = parseImportTime(value("start"))
+        if err != nil {
+            rowProblems = append(rowProblems, fmt.Sprintf("start %s", err))
+        }
+        task.End, err = parseImportTime(value("end"))
+        if err != nil {
+            rowProblems = append(rowProblems, fmt.Sprintf("end %s", err))
+        }
+        if len(rowProblems) == 0 {
+            invalidWindow, err := validateTaskWindow(db, storyID, task.Start, task.End)
+            if err != nil {
+                return []importedTask{}, []string{}, err
+            }
+            if invalidWindow != "" {
+                rowProblems = append(rowProblems, invalidWindow)
+            }
+        }
+
+        if len(rowProblems) > 0 {
+            problems = append(problems, fmt.Sprintf("Row %d: %s", i + 2, strings.Join(rowProblems, ", ")))
+            continue
+        }
+        tasks = append(tasks, task)
+    }
+    return tasks, problems, nil
+}
+
+func insertImportedTasks(db *sql.DB, storyID int64, tasks []importedTask) ([]int64, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return []int64{}, err
+    }
+    defer tx.Rollback()
+
+    taskIDs := []int64{}
+    for _, task := range tasks {
+        result, err := tx.Exec(`
+            INSERT INTO task (story_id, name, description, slots, exclusive_group, section, start_time, end_time, position)
+            SELECT $1, $2, $3, $4, $5, $6, $7, $8, ` + nextTaskPosition + `
+            FROM task
+            WHERE story_id = $1
+            `,
+            storyID, task.Name, task.Description, task.Slots, task.Group, task.Section, task.Start, task.End,
+        )
+        if err != nil {
+            return []int64{}, err
+        }
+        id, err := result.LastInsertId()
+        if err != nil {
+            return []int64{}, err
+        }
+        taskIDs = append(taskIDs, id)
+    }
+    return taskIDs, tx.Commit()
+}
+
+func renderTaskImport(w http.ResponseWriter, r *http.Request, data TaskImportData) {
+    renderTemplate(w, r, "task-import", "task-import-result", data)
+}
+
+// ImportTasksFinalizeHandler creates tasks of a draft story from an uploaded
+// CSV file. Nothing is created unless every row is valid.
+func ImportTasksFinalizeHandler (w http.ResponseWriter, r *http.Request) {
+    err := r.ParseMultipartForm(1 << 20)
+    if err != nil {
+        writeError(w, r, apperror.Validation("Cannot parse form"))
+        return
+    }
+    file, _, err := r.FormFile("file")
+    if err != nil {
+        writeError(w, r, apperror.Validation("Cannot read uploaded file"))
+        return
+    }
+    defer file.Close()
+
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, userID, ok := storyFromRequest(w, r, db, false)
+    if !ok {
+        return
+    }
+    row := db.QueryRow("SELECT status FROM story WHERE id = $1", storyID)
+    var statusOption sql.NullInt64
+    err = row.Scan(&statusOption)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if statusOption.Int64 != 0 {
+        writeError(w, r, apperror.Validation("Tasks can only be imported while the story is being created"))
+        return
+    }
+
+    imported, problems, err := parseTaskImport(db, storyID, file)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error checking imported tasks", err))
+        return
+    }
+    if len(problems) > 0 {
+        renderTaskImport(w, r, TaskImportData{ Errors: problems })
+        return
+    }
+    taskIDs, err := insertImportedTasks(db, storyID, imported)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating tasks", err))
+        return
+    }
+
+    tasks := []Task{}
+    for _, taskID := range taskIDs {
+        task, err := GetSingleTask(db, taskID, userID)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error getting task data", err))
+            return
+        }
+        task.IsStoryOrganizer = true
+        task.IsUserLoggedIn = true
+        publishTaskEvent(db, webhook.TaskCreated, task)
+        tasks = append(tasks, task)
+    }
+    renderTaskImport(w, r, TaskImportData{ Tasks: tasks })
+}
@@ -1,32 +1,76 @@
-package server
-
-import (
-    "os"
-    "database/sql"
-)
-
-func OpenDB() (*sql.DB, error) {
-    return sql.Open("sqlite", os.Getenv("DB_PATH"))
-}
-
-func GetTasks(db *sql.DB) ([]Task, error) {
-    rows, err := db.Query("SELECT task.id, task.name FROM task")
-    if err != nil {
-        return []Task{}, err
-    }
-    defer rows.Close()
-
-    tasks := []Task{}
-    for rows.Next() {
-        var id int64
-        var name string
-
-        err = rows.Scan(&id, &name)
-        if err != nil {
-            return []Task{}, err
-        }
-
-        tasks = append(tasks, Task { ID: id, Name: name })
-    }
-    return tasks, nil
+package server
+
+import (
+    "fmt"
+    "strings"
+    "database/sql"
+    "zmtwc/sk/internal/config"
+)
+
+// settings is the configuration of the running server, set once by Configure at startup.
+var settings config.Config
+
+func Configure(loaded config.Config) {
+    settings = loaded
+}
+
+var pool *sql.DB
+
+// OpenPool opens the database shared by all handlers and background workers.
+// Its connections wait on a locked database instead of failing right away, so
+// concurrent writers queue up behind each other, and start transactions as writers.
+func OpenPool() error {
+    dsn := settings.DBPath
+    separator := "?"
+    if strings.Contains(dsn, "?") {
+        separator = "&"
+    }
+    db, err := sql.Open(observedDriverName, dsn + separator + "_pragma=busy_timeout(5000)&_txlock=immediate")
+    if err != nil {
+        return err
+    }
+    err = db.Ping()
+    if err != nil {
+        db.Close()
+        return err
+    }
+    pool = db
+    return nil
+}
+
+func ClosePool() error {
+    if pool == nil {
+        return nil
+    }
+    return pool.Close()
+}
+
+// OpenDB returns the shared pool, callers must not close it.
+func OpenDB() (*sql.DB, error) {
+    if pool == nil {
+        return nil, fmt.Errorf("Database is not open")
+    }
+    return pool, nil
+}
+
+func GetTasks(db *sql.DB) ([]Task, error) {
+    rows, err := db.Query("SELECT task.id, task.name FROM task")
+    if err != nil {
+        return []Task{}, err
+    }
+    defer rows.Close()
+
+    tasks := []Task{}
+    for rows.Next() {
+        var id int64
+        var name string
+
+        err = rows.Scan(&id, &name)
+        if err != nil {
+            return []Task{}, err
+        }
+
+        tasks = append(tasks, Task { ID: id, Name: name })
+    }
+    return tasks, nil
 }
\ No newline at end of file
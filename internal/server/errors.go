@@ -0,0 +1,55 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "strings"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/logging"
+)
+
+type ErrorData struct {
+    Message string `json:"error"`
+    RequestID string `json:"request_id"`
+}
+
+func wantsJSON(r *http.Request) bool {
+    return r.Header.Get("HX-Request") == "" && strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeError answers with the user-safe message of err, as JSON to API clients
+// and as a fragment htmx shows in #errors otherwise. The full error goes to the
+// log together with the request ID the user is shown.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+    appErr := apperror.From(err)
+    if appErr.Kind == apperror.KindInternal {
+        slog.ErrorContext(r.Context(), "Request failed", "error", appErr.Error(), "stack", string(appErr.Stack))
+    } else {
+        slog.DebugContext(r.Context(), "Request rejected", "error", appErr.Error())
+    }
+    data := ErrorData{ Message: appErr.PublicMessage(), RequestID: logging.RequestID(r.Context()) }
+
+    if wantsJSON(r) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(appErr.Status())
+        json.NewEncoder(w).Encode(data)
+        return
+    }
+    var buffer bytes.Buffer
+    err = executeTemplate(&buffer, "error", "error", data)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Error building template", "template", "error", "error", err)
+        http.Error(w, data.Message, appErr.Status())
+        return
+    }
+    if r.Header.Get("HX-Request") != "" {
+        w.Header().Set("HX-Retarget", "#errors")
+        w.Header().Set("HX-Reswap", "innerHTML")
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(appErr.Status())
+    buffer.WriteTo(w)
+}
@@ -1,25 +1,23 @@
-package server
-
-import (
-    "html/template"
-    "net/http"
-    "zmtwc/sk/internal/auth"
-    "fmt"
-)
-
-func HeaderHandler (w http.ResponseWriter, r *http.Request) {
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-    _, _, err = auth.ValidateSession(db, r);
-
-    tmpl := template.Must(template.ParseFiles("app/templates/header.html"))
-    if err == nil {
-        tmpl.ExecuteTemplate(w, "logged-in-header", nil)
-    } else {
-        tmpl.ExecuteTemplate(w, "logged-out-header", nil)
-    }
-}
+package server
+
+import (
+    "net/http"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+)
+
+func HeaderHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+
+    if err == nil {
+        unreadCount, _ := CountUnreadNotifications(db, userID)
+        renderTemplate(w, r, "header", "logged-in-header", map[string]any{ "UnreadCount": unreadCount })
+    } else {
+        renderTemplate(w, r, "header", "logged-out-header", nil)
+    }
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+type ComponentStatus struct {
+    Status string `json:"status"`
+    Detail string `json:"detail,omitempty"`
+}
+
+type HealthReport struct {
+    Status string `json:"status"`
+    Components map[string]ComponentStatus `json:"components,omitempty"`
+}
+
+var shuttingDown atomic.Bool
+
+var workersMu sync.Mutex
+
+// workers are the background workers the server needs, by name, with a
+// function telling whether they are still running.
+var workers = map[string]func() bool{
+    "webhooks": func() bool { return webhooks.Running() },
+}
+
+func watchWorker(name string, running func() bool) {
+    workersMu.Lock()
+    defer workersMu.Unlock()
+    workers[name] = running
+}
+
+// SetShuttingDown makes the server report that it is not ready, so the load
+// balancer stops sending requests before the server drains the open ones.
+func SetShuttingDown() {
+    shuttingDown.Store(true)
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport, status int) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(report)
+}
+
+// HealthzHandler answers as long as the process serves requests.
+func HealthzHandler (w http.ResponseWriter, r *http.Request) {
+    writeHealthReport(w, HealthReport{ Status: "ok" }, 200)
+}
+
+func checkDatabase(ctx context.Context) ComponentStatus {
+    db, err := OpenDB()
+    if err == nil {
+        err = db.PingContext(ctx)
+    }
+    if err != nil {
+        slog.ErrorContext(ctx, "Readiness check of the database failed", "error", err)
+        return ComponentStatus{ Status: "failing", Detail: "database is not reachable" }
+    }
+    return ComponentStatus{ Status: "ok" }
+}
+
+func checkMigrations(ctx context.Context) ComponentStatus {
+    db, err := OpenDB()
+    if err != nil {
+        return ComponentStatus{ Status: "failing", Detail: "database is not reachable" }
+    }
+    pending, err := PendingMigrations(db)
+    if err != nil {
+        slog.ErrorContext(ctx, "Readiness check of the migrations failed", "error", err)
+        return ComponentStatus{ Status: "failing", Detail: "schema version cannot be read" }
+    }
+    if pending > 0 {
+        return ComponentStatus{ Status: "failing", Detail: fmt.Sprintf("%d migrations pending", pending) }
+    }
+    return ComponentStatus{ Status: "ok" }
+}
+
+// ReadyzHandler reports whether the server can take requests: the database is
+// reachable, its schema is current, the background workers run and the server
+// is not shutting down. It answers 503 otherwise.
+func ReadyzHandler (w http.ResponseWriter, r *http.Request) {
+    ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+    defer cancel()
+
+    components := map[string]ComponentStatus{
+        "database": checkDatabase(ctx),
+        "migrations": checkMigrations(ctx),
+        "server": { Status: "ok" },
+    }
+    if shuttingDown.Load() {
+        components["server"] = ComponentStatus{ Status: "failing", Detail: "shutting down" }
+    }
+
+    workersMu.Lock()
+    for name, running := range workers {
+        if running() {
+            components[name] = ComponentStatus{ Status: "ok" }
+        } else {
+            components[name] = ComponentStatus{ Status: "failing", Detail: "stopped" }
+        }
+    }
+    workersMu.Unlock()
+
+    report := HealthReport{ Status: "ready", Components: components }
+    status := 200
+    for _, component := range components {
+        if component.Status != "ok" {
+            report.Status = "not ready"
+            status = 503
+        }
+    }
+    writeHealthReport(w, report, status)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+
+    "github.com/gorilla/mux"
+)
+
+type InboxEntry struct {
+    ID int64
+    Message string
+    StoryID int64
+    CreatedAt string
+    IsRead bool
+}
+
+type InboxData struct {
+    Entries []InboxEntry
+    UnreadCount int64
+}
+
+func addInboxNotification(db *sql.DB, userID int64, kind string, message string, storyID int64) error {
+    storyOption := sql.NullInt64{ Int64: storyID, Valid: storyID != 0 }
+    _, err := db.Exec(
+        "INSERT INTO notification (user_id, kind, message, story_id, created_at) VALUES($1, $2, $3, $4, $5)",
+        userID, kind, message, storyOption, time.Now().Unix(),
+    )
+    return err
+}
+
+func CountUnreadNotifications(db *sql.DB, userID int64) (int64, error) {
+    row := db.QueryRow("SELECT COUNT(*) FROM notification WHERE user_id = $1 AND read_at IS NULL", userID)
+    var count int64
+    err := row.Scan(&count)
+    return count, err
+}
+
+func GetInboxEntries(db *sql.DB, userID int64) ([]InboxEntry, error) {
+    rows, err := db.Query(`
+        SELECT id, message, story_id, created_at, read_at IS NOT NULL
+        FROM notification
+        WHERE user_id = $1
+        ORDER BY id DESC
+        LIMIT 50
+        `,
+        userID,
+    )
+    if err != nil {
+        return []InboxEntry{}, err
+    }
+    defer rows.Close()
+
+    entries := []InboxEntry{}
+    for rows.Next() {
+        var entry InboxEntry
+        var storyOption sql.NullInt64
+        var createdAt int64
+        err = rows.Scan(&entry.ID, &entry.Message, &storyOption, &createdAt, &entry.IsRead)
+        if err != nil {
+            return []InboxEntry{}, err
+        }
+        entry.StoryID = storyOption.Int64
+        entry.CreatedAt = time.Unix(createdAt, 0).Format(DisplayTimeFormat)
+        entries = append(entries, entry)
+    }
+    return entries, nil
+}
+
+func renderInbox(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) {
+    entries, err := GetInboxEntries(db, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting notifications", err))
+        return
+    }
+    unreadCount, err := CountUnreadNotifications(db, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting notifications", err))
+        return
+    }
+
+    renderTemplate(w, r, "inbox", "inbox", InboxData{ Entries: entries, UnreadCount: unreadCount })
+}
+
+func InboxHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+    renderInbox(w, r, db, userID)
+}
+
+func InboxBadgeHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+    unreadCount, err := CountUnreadNotifications(db, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting notifications", err))
+        return
+    }
+
+    renderTemplate(w, r, "header", "inbox-badge", unreadCount)
+}
+
+func MarkNotificationReadHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    notificationID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+
+    _, err = db.Exec(
+        "UPDATE notification SET read_at = $1 WHERE id = $2 AND user_id = $3 AND read_at IS NULL",
+        time.Now().Unix(), notificationID, userID,
+    )
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating notification", err))
+        return
+    }
+    w.Header().Add("HX-Trigger", "inbox-changed")
+    renderInbox(w, r, db, userID)
+}
+
+func MarkAllNotificationsReadHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+
+    _, err = db.Exec("UPDATE notification SET read_at = $1 WHERE user_id = $2 AND read_at IS NULL", time.Now().Unix(), userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating notifications", err))
+        return
+    }
+    w.Header().Add("HX-Trigger", "inbox-changed")
+    renderInbox(w, r, db, userID)
+}
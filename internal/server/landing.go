@@ -1,157 +1,202 @@
-package server
-
-import (
-    "html/template"
-    "log"
-    "fmt"
-    "os"
-    "net/url"
-    "net/http"
-    "zmtwc/sk/internal/auth"
-    "io"
-    "encoding/json"
-)
-
-type User struct {
-    ID int64
-    Username string
-}
-
-/*
-{
-  "success": true|false,
-  "challenge_ts": timestamp,  // timestamp of the challenge load (ISO format yyyy-MM-dd'T'HH:mm:ssZZ)
-  "hostname": string,         // the hostname of the site where the reCAPTCHA was solved
-  "error-codes": [...]        // optional
-}
-*/
-type RecaptchaResponse struct {
-    Success bool `json:"success"`
-    ChallengeTs string `json:"challenge_ts"`
-    Hostname string `json:"hostname"`
-}
-
-func RegisterPageHandler (w http.ResponseWriter, r *http.Request) {
-    recaptchaKey := os.Getenv("RECAPTCHA_CLIENT_KEY")
-    tmpl := template.Must(template.ParseFiles("app/templates/register.html", "app/templates/spinner.html"))
-    tmpl.Execute(w, recaptchaKey)
-}
-
-func DoRegisterHandler (w http.ResponseWriter, r *http.Request) {
-    username := r.PostFormValue("username")
-    password := r.PostFormValue("password")
-    recaptchaResponse := r.PostFormValue("g-recaptcha-response")
-    recaptchaKey := os.Getenv("RECAPTCHA_SERVER_KEY")
-
-    if recaptchaResponse == "" {
-        http.Error(w, "Please fill out recaptcha", 401)
-        return
-    }
-
-    resp, err := http.PostForm("https://www.google.com/recaptcha/api/siteverify", url.Values{"secret": {recaptchaKey}, "response": {recaptchaResponse}})
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting recaptcha response: %s", err), 500)
-        return
-    }
-    defer resp.Body.Close()
-
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting recaptcha body: %s", err), 500)
-        return
-    }
-
-    var result RecaptchaResponse
-    if err := json.Unmarshal(body, &result); err != nil {  // Parse []byte to the go struct pointer
-        http.Error(w, fmt.Sprintf("Error parsing recaptcha json from body %s: %s", body, err), 500)
-        return
-    }
-
-    if result.Success == false {  // Parse []byte to the go struct pointer
-        http.Error(w, fmt.Sprintf("Invalid recaptcha: %v", result), 401)
-        return
-    }
-
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    userID, err := auth.SavePasswordForUser(db, username, password)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error storing password: %s", err), 500)
-        return
-    }
-
-    sessionID, err := auth.GenerateSessionID(db, userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error generating session ID: %s", err), 500)
-        return
-    }
-    w.Header().Add("HX-Redirect", "/")
-    w.Header().Add("Set-Cookie", "session-id:"+sessionID)
-}
-
-func LoginPageHandler (w http.ResponseWriter, r *http.Request) {
-    tmpl := template.Must(template.ParseFiles("app/templates/login.html", "app/templates/spinner.html"))
-    tmpl.Execute(w, nil)
-}
-
-func DoLoginHandler (w http.ResponseWriter, r *http.Request) {
-    username := r.PostFormValue("username")
-    password := r.PostFormValue("password")
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    userID, err := auth.IsPasswordMatching(db, username, password)
-    if err != nil {
-        http.Error(w, "Incorrect password", 401)
-        return
-    }
-
-    sessionID, err := auth.GenerateSessionID(db, userID)
-    if err == nil {
-        w.Header().Add("HX-Redirect", "/")
-        w.Header().Add("Set-Cookie", "session-id:"+sessionID)
-        tmpl := template.Must(template.ParseFiles("app/templates/header.html"))
-        tmpl.ExecuteTemplate(w, "logged-in-header", nil)
-    } else {
-        log.Println(err)
-        http.Error(w, fmt.Sprintf("Error generating session ID: %s", err), 500)
-    }
-}
-
-func DoLogoutHandler (w http.ResponseWriter, r *http.Request) {
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    _ = auth.Logout(db, r)
-    w.Header().Add("HX-Redirect", "/")
-}
-
-type LandingPageData struct {
-    // Users []User
-    IsUserLoggedIn bool
-}
-
-func LandingPage (w http.ResponseWriter, r *http.Request) {
-    tmpl := template.Must(template.ParseFiles(
-        "app/templates/index.html",
-        "app/templates/create-story.html",
-        "app/templates/spinner.html",
-    ))
-    err := tmpl.Execute(w, nil)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
+package server
+
+import (
+    "log/slog"
+    "fmt"
+    "net/url"
+    "net/http"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/logging"
+    "io"
+    "encoding/json"
+)
+
+type User struct {
+    ID int64
+    Username string
+}
+
+/*
+{
+  "success": true|false,
+  "challenge_ts": timestamp,  // timestamp of the challenge load (ISO format yyyy-MM-dd'T'HH:mm:ssZZ)
+  "hostname": string,         // the hostname of the site where the reCAPTCHA was solved
+  "error-codes": [...]        // optional
+}
+*/
+type RecaptchaResponse struct {
+    Success bool `json:"success"`
+    ChallengeTs string `json:"challenge_ts"`
+    Hostname string `json:"hostname"`
+}
+
+// CaptchaProvider describes a captcha service, all of them verify with the same
+// kind of request and answer with RecaptchaResponse.
+type CaptchaProvider struct {
+    ScriptURL string
+    WidgetClass string
+    ResponseField string
+    VerifyURL string
+}
+
+var captchaProviders = map[string]CaptchaProvider{
+    "recaptcha": {
+        ScriptURL: "https://www.google.com/recaptcha/api.js",
+        WidgetClass: "g-recaptcha",
+        ResponseField: "g-recaptcha-response",
+        VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+    },
+    "hcaptcha": {
+        ScriptURL: "https://js.hcaptcha.com/1/api.js",
+        WidgetClass: "h-captcha",
+        ResponseField: "h-captcha-response",
+        VerifyURL: "https://api.hcaptcha.com/siteverify",
+    },
+    "turnstile": {
+        ScriptURL: "https://challenges.cloudflare.com/turnstile/v0/api.js",
+        WidgetClass: "cf-turnstile",
+        ResponseField: "cf-turnstile-response",
+        VerifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+    },
+}
+
+type RegisterPageData struct {
+    Captcha CaptchaProvider
+    CaptchaSiteKey string
+}
+
+// setSessionCookie keeps the session-id:value form that auth.GetSessionID reads.
+func setSessionCookie(w http.ResponseWriter, sessionID string) {
+    cookie := fmt.Sprintf("session-id:%s; Path=/; Max-Age=%d; HttpOnly; SameSite=Lax", sessionID, int64(settings.SessionLifetime.Seconds()))
+    if settings.CookieSecure {
+        cookie += "; Secure"
+    }
+    w.Header().Add("Set-Cookie", cookie)
+}
+
+func RegisterPageHandler (w http.ResponseWriter, r *http.Request) {
+    data := RegisterPageData{ Captcha: captchaProviders[settings.CaptchaProvider], CaptchaSiteKey: settings.CaptchaSiteKey }
+    renderTemplate(w, r, "register", "register.html", data)
+}
+
+func DoRegisterHandler (w http.ResponseWriter, r *http.Request) {
+    username := r.PostFormValue("username")
+    password := r.PostFormValue("password")
+    email := r.PostFormValue("email")
+    captcha, captchaEnabled := captchaProviders[settings.CaptchaProvider]
+    if captchaEnabled {
+        captchaResponse := r.PostFormValue(captcha.ResponseField)
+        if captchaResponse == "" {
+            writeError(w, r, apperror.Unauthorized("Please fill out captcha"))
+            return
+        }
+
+        resp, err := http.PostForm(captcha.VerifyURL, url.Values{"secret": {settings.CaptchaSecretKey}, "response": {captchaResponse}})
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error getting captcha response", err))
+            return
+        }
+        defer resp.Body.Close()
+
+        body, err := io.ReadAll(resp.Body)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error getting captcha body", err))
+            return
+        }
+
+        var result RecaptchaResponse
+        if err := json.Unmarshal(body, &result); err != nil {  // Parse []byte to the go struct pointer
+            writeError(w, r, apperror.Internal(fmt.Sprintf("Error parsing captcha json from body %s", body), err))
+            return
+        }
+
+        if result.Success == false {  // Parse []byte to the go struct pointer
+            slog.InfoContext(r.Context(), "Captcha verification failed", "result", fmt.Sprintf("%v", result))
+            writeError(w, r, apperror.Unauthorized("Captcha verification failed, please try again"))
+            return
+        }
+    }
+
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, err := CreateUser(db, username, password, email)
+    if err == auth.ErrUsernameTaken {
+        writeError(w, r, apperror.Conflict(fmt.Sprintf("The username %s is taken already", username)))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating user", err))
+        return
+    }
+
+    logging.SetUserID(r, userID)
+    sessionID, err := auth.GenerateSessionID(db, userID, settings.SessionLifetime)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error generating session ID", err))
+        return
+    }
+    w.Header().Add("HX-Redirect", "/")
+    setSessionCookie(w, sessionID)
+}
+
+func LoginPageHandler (w http.ResponseWriter, r *http.Request) {
+    renderTemplate(w, r, "login", "login.html", nil)
+}
+
+func DoLoginHandler (w http.ResponseWriter, r *http.Request) {
+    username := r.PostFormValue("username")
+    password := r.PostFormValue("password")
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, err := auth.IsPasswordMatching(db, username, password)
+    recordLogin(err == nil)
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Incorrect password"))
+        return
+    }
+
+    logging.SetUserID(r, userID)
+    sessionID, err := auth.GenerateSessionID(db, userID, settings.SessionLifetime)
+    if err == nil {
+        w.Header().Add("HX-Redirect", "/")
+        setSessionCookie(w, sessionID)
+        renderTemplate(w, r, "header", "logged-in-header", nil)
+    } else {
+        slog.ErrorContext(r.Context(), "Error generating session ID", "error", err)
+        writeError(w, r, apperror.Internal("Error generating session ID", err))
+    }
+}
+
+func DoLogoutHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    _ = auth.Logout(db, r)
+    w.Header().Add("HX-Redirect", "/")
+}
+
+type LandingPageData struct {
+    // Users []User
+    IsUserLoggedIn bool
+    InitialContent string
+}
+
+func renderLandingPage (w http.ResponseWriter, r *http.Request, data LandingPageData) {
+    renderTemplate(w, r, "landing", "index.html", data)
+}
+
+func LandingPage (w http.ResponseWriter, r *http.Request) {
+    renderLandingPage(w, r, LandingPageData{})
+}
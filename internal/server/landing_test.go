@@ -0,0 +1,40 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestRegisterTakenUsername(t *testing.T) {
+    db := openTestDB(t)
+
+    register := func(email string) *httptest.ResponseRecorder {
+        request := httptest.NewRequest("POST", "/register", strings.NewReader("username=alice&password=secret&email=" + email))
+        request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        request.Header.Set("Accept", "application/json")
+        recorder := httptest.NewRecorder()
+        DoRegisterHandler(recorder, request)
+        return recorder
+    }
+
+    recorder := register("alice@example.com")
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("first registration: got status %d, want 200", recorder.Code)
+    }
+    recorder = register("other@example.com")
+    if recorder.Code != http.StatusConflict || !strings.Contains(recorder.Body.String(), "taken") {
+        t.Errorf("second registration: got status %d %s, want 409 saying the name is taken", recorder.Code, recorder.Body.String())
+    }
+
+    var users int
+    var email string
+    err := db.QueryRow("SELECT COUNT(*), MAX(email) FROM user WHERE username = 'alice'").Scan(&users, &email)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if users != 1 || email != "alice@example.com" {
+        t.Errorf("got %d users named alice with email %s, want the first registration only", users, email)
+    }
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+    "bytes"
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/events"
+
+    "github.com/gorilla/mux"
+)
+
+var storyEvents = events.NewHub()
+
+// notifyTaskChanged pushes the current state of the task to everyone viewing its story.
+func notifyTaskChanged(db *sql.DB, taskID int64) {
+    storyID, err := GetTaskStoryID(db, taskID)
+    if err != nil {
+        return
+    }
+    storyEvents.Publish(storyID, events.Event{ Kind: events.TaskChanged, ID: taskID })
+}
+
+func notifyTaskDeleted(storyID int64, taskID int64) {
+    storyEvents.Publish(storyID, events.Event{ Kind: events.TaskDeleted, ID: taskID })
+}
+
+// StopLiveUpdates ends every event stream so the server can shut down.
+func StopLiveUpdates() {
+    storyEvents.Close()
+}
+
+// renderTaskEvent builds the out of band fragment the viewer gets for the event.
+func renderTaskEvent(event events.Event, userID int64, isUserLoggedIn bool) (string, error) {
+    if event.Kind == events.TaskDeleted {
+        return fmt.Sprintf(`<div id="task-element-%d" hx-swap-oob="delete"></div>`, event.ID), nil
+    }
+
+    db, err := OpenDB()
+    if err != nil {
+        return "", err
+    }
+
+    task, err := GetSingleTask(db, event.ID, userID)
+    if err == sql.ErrNoRows {
+        return fmt.Sprintf(`<div id="task-element-%d" hx-swap-oob="delete"></div>`, event.ID), nil
+    }
+    if err != nil {
+        return "", err
+    }
+    task.IsUserLoggedIn = isUserLoggedIn
+    task.SwapOOB = true
+
+    var buffer bytes.Buffer
+    err = executeTemplate(&buffer, "task-view", "task-list-element-view.html", task)
+    if err != nil {
+        return "", err
+    }
+    return buffer.String(), nil
+}
+
+func writeServerSentEvent(w http.ResponseWriter, name string, data string) {
+    fmt.Fprintf(w, "event: %s\n", name)
+    for _, line := range strings.Split(data, "\n") {
+        fmt.Fprintf(w, "data: %s\n", strings.TrimRight(line, "\r"))
+    }
+    fmt.Fprint(w, "\n")
+}
+
+func StoryEventsHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+    userID, _, sessionErr := auth.ValidateSession(db, r);
+    canView, err := CanViewStory(db, storyID, userID, r.URL.Query().Get("key"))
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+
+    // the stream outlives the write timeout of the server
+    controller := http.NewResponseController(w)
+    err = controller.SetWriteDeadline(time.Time{})
+    if err != nil {
+        writeError(w, r, apperror.Internal("Streaming is not supported", err))
+        return
+    }
+    subscription, unsubscribe := storyEvents.Subscribe(storyID)
+    defer unsubscribe()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(200)
+    controller.Flush()
+
+    heartbeat := time.NewTicker(30 * time.Second)
+    defer heartbeat.Stop()
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-heartbeat.C:
+            fmt.Fprint(w, ": ping\n\n")
+            controller.Flush()
+        case event, ok := <-subscription:
+            if !ok {
+                return
+            }
+            fragment, err := renderTaskEvent(event, userID, sessionErr == nil)
+            if err != nil {
+                continue
+            }
+            writeServerSentEvent(w, "task", fragment)
+            controller.Flush()
+        }
+    }
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+    "database/sql"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+    "zmtwc/sk/internal/logging"
+    "zmtwc/sk/internal/metrics"
+
+    _ "modernc.org/sqlite"
+)
+
+// observedDriverName is the SQLite driver with every statement timed for the metrics.
+const observedDriverName = "sqlite-observed"
+
+var registry = metrics.NewRegistry()
+
+var httpRequests = registry.NewCounterVec("sk_http_requests_total", "HTTP requests by route template and status.", "method", "route", "status")
+
+var httpDuration = registry.NewHistogramVec("sk_http_request_duration_seconds", "Time taken to answer HTTP requests.", metrics.DefaultBuckets, "method", "route")
+
+var dbDuration = registry.NewHistogramVec("sk_db_query_duration_seconds", "Time taken by database statements.", metrics.DefaultBuckets, "operation")
+
+var logins = registry.NewCounterVec("sk_logins_total", "Login attempts by result.", "result")
+
+func init() {
+    // sql.Open only looks up the driver, it does not connect
+    db, err := sql.Open("sqlite", "")
+    if err != nil {
+        panic(err)
+    }
+    sql.Register(observedDriverName, metrics.ObservedDriver{ Driver: db.Driver(), Observe: func(operation string, duration time.Duration) {
+        dbDuration.Observe(duration.Seconds(), operation)
+    }})
+    db.Close()
+
+    registry.NewGaugeFunc("sk_active_sessions", "Sessions that have not expired.", func() (float64, error) {
+        return countRows(`
+            SELECT COUNT(*)
+            FROM access_token
+            JOIN user ON user.id = access_token.user_id
+            WHERE access_token.valid_to > $1 AND COALESCE(user.disabled, 0) = 0
+            `,
+            time.Now().Unix(),
+        )
+    })
+    registry.NewGaugeFunc("sk_published_stories", "Published stories that have not ended yet.", func() (float64, error) {
+        return countRows(
+            "SELECT COUNT(*) FROM story WHERE status > 0 AND COALESCE(end_time, start_time, $1) >= $1",
+            time.Now().Unix(),
+        )
+    })
+    registry.NewGaugeFunc("sk_open_slots", "Free slots in tasks of published stories that have not ended yet.", func() (float64, error) {
+        return countRows(`
+            SELECT COALESCE(SUM(MAX(task.slots - (SELECT COUNT(*) FROM assignment WHERE assignment.task_id = task.id), 0)), 0)
+            FROM task
+            JOIN story ON story.id = task.story_id
+            WHERE story.status > 0 AND COALESCE(story.end_time, story.start_time, $1) >= $1
+            `,
+            time.Now().Unix(),
+        )
+    })
+}
+
+func countRows(query string, args ...any) (float64, error) {
+    db, err := OpenDB()
+    if err != nil {
+        return 0, err
+    }
+    var count int64
+    err = db.QueryRow(query, args...).Scan(&count)
+    return float64(count), err
+}
+
+// ObserveRequest records a finished request. Requests that matched no route and
+// unusual methods are counted together so scanners cannot add label values.
+func ObserveRequest(summary logging.Summary) {
+    route := summary.Route
+    if route == "" {
+        route = "unmatched"
+    }
+    method := summary.Method
+    switch method {
+    case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+    default:
+        method = "other"
+    }
+    httpRequests.Inc(method, route, strconv.Itoa(summary.Status))
+    httpDuration.Observe(summary.Latency.Seconds(), method, route)
+}
+
+func recordLogin(success bool) {
+    if success {
+        logins.Inc("success")
+    } else {
+        logins.Inc("failure")
+    }
+}
+
+// MetricsHandler serves the metrics, protected by the configured token if there is one.
+func MetricsHandler() http.Handler {
+    return registry.Handler(settings.MetricsToken, func(r *http.Request, err error) {
+        slog.ErrorContext(r.Context(), "Error reading metrics", "error", err)
+    })
+}
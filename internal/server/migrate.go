@@ -0,0 +1,296 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+)
+
+// migrations bring databases created from an older init.sql up to date, in
+// order. The database counts the ones it has run in PRAGMA user_version, the
+// schema init.sql had before these changes is version 0 and init.sql sets the
+// count for new databases, so every change to init.sql needs a migration here
+// as well. SQLite cannot add UNIQUE columns, those get a unique index instead.
+var migrations = []string{
+    // visibility, invitees and invite links
+    `
+    ALTER TABLE story ADD COLUMN visibility INTEGER DEFAULT 0;
+    CREATE TABLE story_invitee (
+        story_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        PRIMARY KEY (story_id, user_id),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id),
+        FOREIGN KEY (user_id)
+          REFERENCES user (id)
+    );
+    CREATE TABLE story_invite_link (
+        id INTEGER NOT NULL,
+        story_id INTEGER NOT NULL,
+        token TEXT NOT NULL UNIQUE,
+        revoked INTEGER DEFAULT 0,
+        PRIMARY KEY (id),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id)
+    );
+    `,
+    // co-organizers
+    `
+    ALTER TABLE user ADD COLUMN email TEXT;
+    CREATE TABLE story_organizer (
+        story_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        PRIMARY KEY (story_id, user_id),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id),
+        FOREIGN KEY (user_id)
+          REFERENCES user (id)
+    );
+    `,
+    // locked tasks and the assignment log
+    `
+    ALTER TABLE task ADD COLUMN locked INTEGER DEFAULT 0;
+    CREATE TABLE assignment_log (
+        id INTEGER NOT NULL,
+        task_id INTEGER NOT NULL,
+        assignee_id INTEGER NOT NULL,
+        actor_id INTEGER NOT NULL,
+        action TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        PRIMARY KEY (id),
+        FOREIGN KEY (task_id)
+          REFERENCES task (id),
+        FOREIGN KEY (assignee_id)
+          REFERENCES user (id),
+        FOREIGN KEY (actor_id)
+          REFERENCES user (id)
+    );
+    `,
+    // one assignment per user and task, keeping the first of duplicates
+    `
+    DELETE FROM assignment
+    WHERE assignee_id IS NOT NULL AND id NOT IN (
+        SELECT MIN(id) FROM assignment WHERE assignee_id IS NOT NULL GROUP BY task_id, assignee_id
+    );
+    CREATE UNIQUE INDEX assignment_task_assignee ON assignment (task_id, assignee_id);
+    `,
+    // task limit and exclusive groups
+    `
+    ALTER TABLE story ADD COLUMN max_tasks_per_user INTEGER DEFAULT 0;
+    ALTER TABLE task ADD COLUMN exclusive_group TEXT;
+    `,
+    // time windows
+    `
+    ALTER TABLE story ADD COLUMN end_time INTEGER;
+    ALTER TABLE task ADD COLUMN start_time INTEGER;
+    ALTER TABLE task ADD COLUMN end_time INTEGER;
+    `,
+    // sections and positions
+    `
+    ALTER TABLE task ADD COLUMN section TEXT;
+    ALTER TABLE task ADD COLUMN position INTEGER DEFAULT 0;
+    `,
+    // attendance
+    `
+    ALTER TABLE story ADD COLUMN max_no_shows INTEGER DEFAULT 0;
+    ALTER TABLE assignment ADD COLUMN attendance INTEGER DEFAULT 0;
+    ALTER TABLE assignment ADD COLUMN checked_in_at INTEGER;
+    `,
+    // comments
+    `
+    CREATE TABLE comment (
+        id INTEGER NOT NULL,
+        story_id INTEGER NOT NULL,
+        task_id INTEGER,
+        author_id INTEGER NOT NULL,
+        body TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        edited_at INTEGER,
+        PRIMARY KEY (id),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id),
+        FOREIGN KEY (task_id)
+          REFERENCES task (id),
+        FOREIGN KEY (author_id)
+          REFERENCES user (id)
+    );
+    `,
+    // calendar feeds
+    `
+    ALTER TABLE user ADD COLUMN calendar_token TEXT;
+    CREATE UNIQUE INDEX user_calendar_token ON user (calendar_token);
+    `,
+    // notification settings
+    `
+    CREATE TABLE notification_setting (
+        user_id INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        enabled INTEGER NOT NULL DEFAULT 1,
+        PRIMARY KEY (user_id, kind),
+        FOREIGN KEY (user_id)
+          REFERENCES user (id)
+    );
+    `,
+    // reminders
+    `
+    CREATE TABLE story_reminder (
+        story_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        lead INTEGER NOT NULL,
+        start_time INTEGER NOT NULL,
+        sent_at INTEGER NOT NULL,
+        PRIMARY KEY (story_id, user_id, lead, start_time),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id),
+        FOREIGN KEY (user_id)
+          REFERENCES user (id)
+    );
+    `,
+    // administrators and webhooks
+    `
+    ALTER TABLE user ADD COLUMN is_admin INTEGER DEFAULT 0;
+    CREATE TABLE webhook (
+        id INTEGER NOT NULL,
+        story_id INTEGER NOT NULL,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        creator_id INTEGER NOT NULL,
+        created_at INTEGER NOT NULL,
+        PRIMARY KEY (id),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id),
+        FOREIGN KEY (creator_id)
+          REFERENCES user (id)
+    );
+    CREATE TABLE webhook_delivery (
+        id INTEGER NOT NULL,
+        webhook_id INTEGER NOT NULL,
+        delivery_id TEXT NOT NULL,
+        event TEXT NOT NULL,
+        attempt INTEGER NOT NULL,
+        status_code INTEGER,
+        error TEXT,
+        payload TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        PRIMARY KEY (id),
+        FOREIGN KEY (webhook_id)
+          REFERENCES webhook (id)
+    );
+    `,
+    // the notification inbox
+    `
+    CREATE TABLE notification (
+        id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        message TEXT NOT NULL,
+        story_id INTEGER,
+        created_at INTEGER NOT NULL,
+        read_at INTEGER,
+        PRIMARY KEY (id),
+        FOREIGN KEY (user_id)
+          REFERENCES user (id),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id)
+    );
+    `,
+    // signup times for the export
+    "ALTER TABLE assignment ADD COLUMN joined_at INTEGER",
+    // disabled users
+    "ALTER TABLE user ADD COLUMN disabled INTEGER DEFAULT 0",
+    // attendance kept apart from assignments, so leaving a task keeps no-shows
+    `
+    CREATE TABLE attendance_record (
+        task_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        story_id INTEGER NOT NULL,
+        attendance INTEGER NOT NULL,
+        recorded_at INTEGER NOT NULL,
+        PRIMARY KEY (task_id, user_id),
+        FOREIGN KEY (story_id)
+          REFERENCES story (id),
+        FOREIGN KEY (user_id)
+          REFERENCES user (id)
+    );
+    INSERT INTO attendance_record (task_id, user_id, story_id, attendance, recorded_at)
+    SELECT assignment.task_id, assignment.assignee_id, task.story_id, assignment.attendance, COALESCE(assignment.checked_in_at, strftime('%s', 'now'))
+    FROM assignment
+    JOIN task ON task.id = assignment.task_id
+    WHERE assignment.assignee_id IS NOT NULL AND assignment.attendance > 0;
+    `,
+    // attendance only kept in attendance_record
+    `
+    ALTER TABLE assignment DROP COLUMN attendance;
+    ALTER TABLE assignment DROP COLUMN checked_in_at;
+    `,
+}
+
+func getSchemaVersion(db *sql.DB) (int, error) {
+    var version int
+    err := db.QueryRow("PRAGMA user_version").Scan(&version)
+    return version, err
+}
+
+// PendingMigrations returns how many migrations the database still needs,
+// or an error when it has no schema at all.
+func PendingMigrations(db *sql.DB) (int, error) {
+    var tables int
+    err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'user'").Scan(&tables)
+    if err != nil {
+        return 0, err
+    }
+    if tables == 0 {
+        return 0, fmt.Errorf("Database has no schema")
+    }
+    version, err := getSchemaVersion(db)
+    if err != nil {
+        return 0, err
+    }
+    if version > len(migrations) {
+        return 0, fmt.Errorf("Database schema version %d is newer than this server", version)
+    }
+    return len(migrations) - version, nil
+}
+
+// Migrate creates the schema in an empty database, otherwise
+// runs the pending migrations, each in its own transaction. It returns the
+// resulting schema version.
+func Migrate(db *sql.DB, schema string) (int, error) {
+    var tables int
+    err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables)
+    if err != nil {
+        return 0, err
+    }
+    if tables == 0 {
+        _, err = db.Exec(schema)
+        if err != nil {
+            return 0, fmt.Errorf("Error creating schema: %s", err)
+        }
+        return getSchemaVersion(db)
+    }
+
+    pending, err := PendingMigrations(db)
+    if err != nil {
+        return 0, err
+    }
+    for version := len(migrations) - pending; version < len(migrations); version++ {
+        tx, err := db.Begin()
+        if err != nil {
+            return version, err
+        }
+        _, err = tx.Exec(migrations[version])
+        if err != nil {
+            tx.Rollback()
+            return version, fmt.Errorf("Error running migration %d: %s", version + 1, err)
+        }
+        _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version + 1))
+        if err != nil {
+            tx.Rollback()
+            return version, err
+        }
+        err = tx.Commit()
+        if err != nil {
+            return version, err
+        }
+    }
+    return len(migrations), nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "database/sql"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strings"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/notify"
+)
+
+const (
+    NotificationStoryChanges = "story"
+    NotificationTaskChanges = "task"
+    NotificationAssignmentChanges = "assignment"
+    NotificationReminders = "reminder"
+)
+
+var notificationKinds = []NotificationSetting{
+    { Kind: NotificationStoryChanges, Label: "Story time changes" },
+    { Kind: NotificationTaskChanges, Label: "Deleted tasks" },
+    { Kind: NotificationAssignmentChanges, Label: "Being removed from or moved between tasks" },
+    { Kind: NotificationReminders, Label: "Reminders a day and an hour before a story starts" },
+}
+
+var mailQueue *notify.Queue
+
+type NotificationSetting struct {
+    Kind string
+    Label string
+    Enabled bool
+}
+
+type NotificationData struct {
+    StoryID int64
+    Username string
+    ActorName string
+    StoryTitle string
+    TaskName string
+    TargetTaskName string
+    StartTime string
+    EndTime string
+    TaskNames []string
+}
+
+// StartNotifications sends notification mails through the mailer from now on.
+// The returned queue has to be closed on shutdown so queued mails are not lost.
+func StartNotifications(mailer notify.Mailer) *notify.Queue {
+    mailQueue = notify.NewQueue(mailer, 100)
+    watchWorker("mail", mailQueue.Running)
+    return mailQueue
+}
+
+func renderEmail(templateName string, data NotificationData) (notify.Message, error) {
+    var buffer bytes.Buffer
+    err := executeEmailTemplate(&buffer, templateName, data)
+    if err != nil {
+        return notify.Message{}, err
+    }
+
+    // the first line of every mail template holds the subject
+    reader := bufio.NewReader(&buffer)
+    subject, err := reader.ReadString('\n')
+    if err != nil {
+        return notify.Message{}, fmt.Errorf("Mail template %s has no body", templateName)
+    }
+    var body strings.Builder
+    _, err = reader.WriteTo(&body)
+    if err != nil {
+        return notify.Message{}, err
+    }
+    return notify.Message{
+        Subject: strings.TrimSpace(strings.TrimPrefix(subject, "Subject:")),
+        Body: strings.TrimLeft(body.String(), "\r\n"),
+    }, nil
+}
+
+// notifyUsers puts a notification into the inbox of every user and also queues
+// a mail for the users that have an email and did not opt out of the kind.
+func notifyUsers(db *sql.DB, kind string, userIDs []int64, actorID int64, templateName string, data NotificationData) {
+    for _, userID := range userIDs {
+        if userID == actorID {
+            continue
+        }
+        row := db.QueryRow(`
+            SELECT
+                user.username,
+                user.email,
+                COALESCE((SELECT enabled FROM notification_setting WHERE user_id = user.id AND kind = $2), 1)
+            FROM user
+            WHERE user.id = $1
+            `,
+            userID,
+            kind,
+        )
+        var username string
+        var emailOption sql.NullString
+        var enabled bool
+        err := row.Scan(&username, &emailOption, &enabled)
+        if err != nil {
+            slog.Error("Error getting notification recipient", "user_id", userID, "error", err)
+            continue
+        }
+
+        data.Username = username
+        message, err := renderEmail(templateName, data)
+        if err != nil {
+            slog.Error("Error building mail", "template", templateName, "error", err)
+            return
+        }
+        err = addInboxNotification(db, userID, kind, message.Subject, data.StoryID)
+        if err != nil {
+            slog.Error("Error adding notification", "user_id", userID, "error", err)
+        }
+        if mailQueue == nil || !enabled || emailOption.String == "" {
+            continue
+        }
+        message.To = emailOption.String
+        mailQueue.Enqueue(message)
+    }
+}
+
+func getUsername(db *sql.DB, userID int64) string {
+    row := db.QueryRow("SELECT username FROM user WHERE id = $1", userID)
+    var username string
+    row.Scan(&username)
+    return username
+}
+
+func getAssigneeIDs(db *sql.DB, query string, id int64) ([]int64, error) {
+    rows, err := db.Query(query, id)
+    if err != nil {
+        return []int64{}, err
+    }
+    defer rows.Close()
+
+    userIDs := []int64{}
+    for rows.Next() {
+        var userID int64
+        err = rows.Scan(&userID)
+        if err != nil {
+            return []int64{}, err
+        }
+        userIDs = append(userIDs, userID)
+    }
+    return userIDs, nil
+}
+
+func GetStoryAssigneeIDs(db *sql.DB, storyID int64) ([]int64, error) {
+    return getAssigneeIDs(db, `
+        SELECT DISTINCT assignment.assignee_id
+        FROM assignment
+        JOIN task ON task.id = assignment.task_id
+        WHERE task.story_id = $1
+        `,
+        storyID,
+    )
+}
+
+func GetTaskAssigneeIDs(db *sql.DB, taskID int64) ([]int64, error) {
+    return getAssigneeIDs(db, "SELECT assignee_id FROM assignment WHERE task_id = $1", taskID)
+}
+
+// getTaskNames returns the name of the task and the title of its story.
+func getTaskNames(db *sql.DB, taskID int64) (string, string, error) {
+    row := db.QueryRow("SELECT task.name, story.title FROM task JOIN story ON story.id = task.story_id WHERE task.id = $1", taskID)
+    var taskName string
+    var storyTitleOption sql.NullString
+    err := row.Scan(&taskName, &storyTitleOption)
+    return taskName, storyTitleOption.String, err
+}
+
+func GetNotificationSettings(db *sql.DB, userID int64) ([]NotificationSetting, error) {
+    settings := []NotificationSetting{}
+    for _, setting := range notificationKinds {
+        row := db.QueryRow("SELECT enabled FROM notification_setting WHERE user_id = $1 AND kind = $2", userID, setting.Kind)
+        setting.Enabled = true
+        err := row.Scan(&setting.Enabled)
+        if err != nil && err != sql.ErrNoRows {
+            return []NotificationSetting{}, err
+        }
+        settings = append(settings, setting)
+    }
+    return settings, nil
+}
+
+func renderNotificationSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64, saved bool) {
+    settings, err := GetNotificationSettings(db, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting notification settings", err))
+        return
+    }
+    row := db.QueryRow("SELECT email FROM user WHERE id = $1", userID)
+    var emailOption sql.NullString
+    err = row.Scan(&emailOption)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting user", err))
+        return
+    }
+
+    renderTemplate(w, r, "notifications", "notifications.html", map[string]any{
+        "Email": emailOption.String,
+        "Settings": settings,
+        "Saved": saved,
+    })
+}
+
+func NotificationSettingsHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+    renderNotificationSettings(w, r, db, userID, false)
+}
+
+func ChangeNotificationSettingsHandler (w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        writeError(w, r, apperror.Validation("Cannot parse form"))
+        return
+    }
+    email := strings.TrimSpace(r.PostFormValue("email"))
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+
+    _, err = db.Exec("UPDATE user SET email = $1 WHERE id = $2", email, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating email", err))
+        return
+    }
+    enabledKinds := map[string]bool{}
+    for _, kind := range r.PostForm["kind"] {
+        enabledKinds[kind] = true
+    }
+    for _, setting := range notificationKinds {
+        _, err = db.Exec(
+            "INSERT OR REPLACE INTO notification_setting (user_id, kind, enabled) VALUES($1, $2, $3)",
+            userID, setting.Kind, enabledKinds[setting.Kind],
+        )
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error updating notification settings", err))
+            return
+        }
+    }
+    renderNotificationSettings(w, r, db, userID, true)
+}
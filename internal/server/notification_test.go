@@ -0,0 +1,69 @@
+package server
+
+import (
+    "strings"
+    "testing"
+    "zmtwc/sk/internal/notify"
+)
+
+func TestNotifyUsers(t *testing.T) {
+    db := openTestDB(t)
+    err := LoadTemplates()
+    if err != nil {
+        t.Fatal(err)
+    }
+    mailer := &notify.MemoryMailer{}
+    queue := StartNotifications(mailer)
+    t.Cleanup(func() {
+        queue.Close()
+        mailQueue = nil
+    })
+
+    actorID := createTestUser(t, db, "actor")
+    mailedID := createTestUser(t, db, "mailed")
+    optedOutID := createTestUser(t, db, "optedout")
+    noEmailID := createTestUser(t, db, "noemail")
+    mustExec(t, db, "INSERT INTO notification_setting (user_id, kind, enabled) VALUES($1, $2, 0)", optedOutID, NotificationAssignmentChanges)
+    mustExec(t, db, "UPDATE user SET email = NULL WHERE id = $1", noEmailID)
+
+    notifyUsers(db, NotificationAssignmentChanges, []int64{ actorID, mailedID, optedOutID, noEmailID }, actorID, "assignment-moved", NotificationData{
+        StoryID: 1,
+        ActorName: "actor",
+        StoryTitle: "Cleanup",
+        TaskName: "Kitchen",
+        TargetTaskName: "Garden",
+    })
+    // closing waits for the queued mails to be sent
+    queue.Close()
+
+    messages := mailer.Messages()
+    if len(messages) != 1 {
+        t.Fatalf("sent %d mails, want 1: %v", len(messages), messages)
+    }
+    message := messages[0]
+    if message.To != "mailed@example.com" {
+        t.Errorf("mail went to %s, want mailed@example.com", message.To)
+    }
+    if message.Subject != "You were moved to Garden" {
+        t.Errorf("subject is %q", message.Subject)
+    }
+    if !strings.Contains(message.Body, "Hi mailed,") || !strings.Contains(message.Body, `from the task "Kitchen" to "Garden" of "Cleanup"`) {
+        t.Errorf("unexpected body %q", message.Body)
+    }
+
+    // everyone but the actor gets the notification in their inbox, mail or not
+    for _, userID := range []int64{ actorID, mailedID, optedOutID, noEmailID } {
+        var count int
+        err = db.QueryRow("SELECT COUNT(*) FROM notification WHERE user_id = $1 AND message = $2", userID, message.Subject).Scan(&count)
+        if err != nil {
+            t.Fatal(err)
+        }
+        want := 1
+        if userID == actorID {
+            want = 0
+        }
+        if count != want {
+            t.Errorf("user %d has %d notifications, want %d", userID, count, want)
+        }
+    }
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+
+    "github.com/gorilla/mux"
+)
+
+// nextTaskPosition is the position of a new task. Tasks keep position 0 and
+// are listed by their start time until an organizer reorders them, after
+// that new tasks are added at the end.
+const nextTaskPosition = "CASE WHEN MAX(position) > 0 THEN MAX(position) + 1 ELSE 0 END"
+
+type TaskSection struct {
+    Name string
+    Tasks []Task
+}
+
+type TaskJSON struct {
+    ID int64 `json:"id"`
+    Name string `json:"name"`
+    Description string `json:"description"`
+    Position int64 `json:"position"`
+    SlotsTotal int64 `json:"slots_total"`
+    SlotsAssigned int64 `json:"slots_assigned"`
+    TimeWindow string `json:"time_window,omitempty"`
+}
+
+type TaskSectionJSON struct {
+    Name string `json:"name"`
+    Tasks []TaskJSON `json:"tasks"`
+}
+
+type StoryTasksJSON struct {
+    StoryID int64 `json:"story_id"`
+    Sections []TaskSectionJSON `json:"sections"`
+}
+
+func newTaskJSON(task Task) TaskJSON {
+    return TaskJSON{
+        ID: task.ID,
+        Name: task.Name,
+        Description: task.Description,
+        Position: task.Position,
+        SlotsTotal: task.SlotsTotal,
+        SlotsAssigned: task.SlotsAssigned,
+        TimeWindow: task.TimeWindow,
+    }
+}
+
+// GroupTaskSections splits already ordered tasks into sections, keeping the
+// sections in the order their first task appears.
+func GroupTaskSections(tasks []Task) []TaskSection {
+    sections := []TaskSection{}
+    sectionIndex := map[string]int{}
+    for _, task := range tasks {
+        i, ok := sectionIndex[task.Section]
+        if !ok {
+            i = len(sections)
+            sectionIndex[task.Section] = i
+            sections = append(sections, TaskSection{ Name: task.Section })
+        }
+        sections[i].Tasks = append(sections[i].Tasks, task)
+    }
+    return sections
+}
+
+func ReorderStoryTasksHandler (w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        writeError(w, r, apperror.Validation("Cannot parse form"))
+        return
+    }
+    taskValues := r.PostForm["task"]
+    sectionValues := r.PostForm["task_section"]
+    if len(taskValues) != len(sectionValues) {
+        writeError(w, r, apperror.Validation("Every task needs a section value"))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error reordering tasks", err))
+        return
+    }
+    defer tx.Rollback()
+
+    for i, value := range taskValues {
+        taskID, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", value)))
+            return
+        }
+        result, err := tx.Exec(
+            "UPDATE task SET position = $1, section = $2 WHERE id = $3 AND story_id = $4",
+            i + 1, strings.TrimSpace(sectionValues[i]), taskID, storyID,
+        )
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error reordering tasks", err))
+            return
+        }
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error reordering tasks", err))
+            return
+        }
+        if rowsAffected != 1 {
+            writeError(w, r, apperror.Validation(fmt.Sprintf("Task %d does not belong to this story", taskID)))
+            return
+        }
+    }
+    err = tx.Commit()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error reordering tasks", err))
+        return
+    }
+    w.WriteHeader(204)
+}
+
+func StoryTasksJSONHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, _ := auth.ValidateSession(db, r);
+    canView, err := CanViewStory(db, storyID, userID, r.URL.Query().Get("key"))
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+    tasks, err := GetStoryTasks(db, storyID, userID, false, false)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story tasks", err))
+        return
+    }
+
+    data := StoryTasksJSON{ StoryID: storyID, Sections: []TaskSectionJSON{} }
+    for _, section := range GroupTaskSections(tasks) {
+        sectionJSON := TaskSectionJSON{ Name: section.Name, Tasks: []TaskJSON{} }
+        for _, task := range section.Tasks {
+            sectionJSON.Tasks = append(sectionJSON.Tasks, newTaskJSON(task))
+        }
+        data.Sections = append(data.Sections, sectionJSON)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    err = json.NewEncoder(w).Encode(data)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error encoding tasks", err))
+    }
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+
+    "github.com/gorilla/mux"
+)
+
+type Organizer struct {
+    UserID int64
+    Username string
+}
+
+type StoryOrganizersData struct {
+    StoryID int64
+    Organizers []Organizer
+}
+
+func IsStoryOwner(db *sql.DB, storyID int64, userID int64) (bool, error) {
+    row := db.QueryRow("SELECT creator_id FROM story WHERE id = $1", storyID)
+    var creatorID int64
+    err := row.Scan(&creatorID)
+    if err != nil {
+        return false, err
+    }
+    return creatorID == userID, nil
+}
+
+// IsStoryOrganizer checks whether the user can manage the story, which holds
+// for the owner as well as for every co-organizer.
+func IsStoryOrganizer(db *sql.DB, storyID int64, userID int64) (bool, error) {
+    row := db.QueryRow(`
+        SELECT
+            story.creator_id = $2
+            OR EXISTS (SELECT 1 FROM story_organizer WHERE story_organizer.story_id = story.id AND story_organizer.user_id = $2)
+        FROM story
+        WHERE story.id = $1
+        `,
+        storyID,
+        userID,
+    )
+    var isOrganizer bool
+    err := row.Scan(&isOrganizer)
+    if err != nil {
+        return false, err
+    }
+    return isOrganizer, nil
+}
+
+func IsAdmin(db *sql.DB, userID int64) (bool, error) {
+    row := db.QueryRow("SELECT COALESCE(is_admin, 0) FROM user WHERE id = $1", userID)
+    var isAdmin bool
+    err := row.Scan(&isAdmin)
+    if err == sql.ErrNoRows {
+        return false, nil
+    }
+    return isAdmin, err
+}
+
+func GetUserIDByName(db *sql.DB, username string) (int64, error) {
+    row := db.QueryRow("SELECT id FROM user WHERE username = $1", username)
+    var userID int64
+    err := row.Scan(&userID)
+    return userID, err
+}
+
+func GetStoryOrganizers(db *sql.DB, storyID int64) ([]Organizer, error) {
+    organizers := []Organizer{}
+    rows, err := db.Query(`
+        SELECT
+            user.id,
+            user.username
+        FROM story_organizer
+        JOIN user ON user.id = story_organizer.user_id
+        WHERE story_organizer.story_id = $1
+        `,
+        storyID,
+    )
+    if err != nil {
+        return []Organizer{}, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var organizer Organizer
+        err = rows.Scan(&organizer.UserID, &organizer.Username)
+        if err != nil {
+            return []Organizer{}, err
+        }
+        organizers = append(organizers, organizer)
+    }
+    return organizers, nil
+}
+
+func storyFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB, ownerOnly bool) (int64, int64, bool) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return 0, 0, false
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return 0, 0, false
+    }
+
+    var isAllowed bool
+    if ownerOnly {
+        isAllowed, err = IsStoryOwner(db, storyID, userID)
+    } else {
+        isAllowed, err = IsStoryOrganizer(db, storyID, userID)
+    }
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return 0, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return 0, 0, false
+    }
+    if !isAllowed && ownerOnly {
+        writeError(w, r, apperror.Forbidden("Only the story owner can do this"))
+        return 0, 0, false
+    }
+    if !isAllowed {
+        writeError(w, r, apperror.Forbidden("Only story organizers can do this"))
+        return 0, 0, false
+    }
+    return storyID, userID, true
+}
+
+func ownedStoryFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB) (int64, bool) {
+    storyID, _, ok := storyFromRequest(w, r, db, true)
+    return storyID, ok
+}
+
+func organizedStoryFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB) (int64, bool) {
+    storyID, _, ok := storyFromRequest(w, r, db, false)
+    return storyID, ok
+}
+
+// organizedTaskFromRequest resolves the task in the route and makes sure the
+// session user organizes the story the task belongs to.
+func organizedTaskFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB) (int64, int64, bool) {
+    vars := mux.Vars(r)
+    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return 0, 0, false
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return 0, 0, false
+    }
+    storyID, err := GetTaskStoryID(db, taskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return 0, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return 0, 0, false
+    }
+    isOrganizer, err := IsStoryOrganizer(db, storyID, userID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return 0, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return 0, 0, false
+    }
+    if !isOrganizer {
+        writeError(w, r, apperror.Forbidden("Only story organizers can do this"))
+        return 0, 0, false
+    }
+    return taskID, userID, true
+}
+
+func renderStoryOrganizers(w http.ResponseWriter, r *http.Request, db *sql.DB, storyID int64) {
+    organizers, err := GetStoryOrganizers(db, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story organizers", err))
+        return
+    }
+
+    renderTemplate(w, r, "story-organizers", "story-organizers", StoryOrganizersData {
+        StoryID: storyID,
+        Organizers: organizers,
+    })
+}
+
+func StoryOrganizersHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := ownedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    renderStoryOrganizers(w, r, db, storyID)
+}
+
+func AddStoryOrganizerHandler (w http.ResponseWriter, r *http.Request) {
+    username := r.PostFormValue("username")
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, userID, ok := storyFromRequest(w, r, db, true)
+    if !ok {
+        return
+    }
+
+    organizerID, err := GetUserIDByName(db, username)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot find user %s", username)))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting user", err))
+        return
+    }
+    if organizerID == userID {
+        writeError(w, r, apperror.Validation("Story owner is already an organizer"))
+        return
+    }
+
+    _, err = db.Exec("INSERT OR IGNORE INTO story_organizer (story_id, user_id) VALUES($1, $2)", storyID, organizerID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error adding organizer", err))
+        return
+    }
+    renderStoryOrganizers(w, r, db, storyID)
+}
+
+func RemoveStoryOrganizerHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    organizerID, err := strconv.ParseInt(vars["userID"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["userID"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := ownedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    _, err = db.Exec("DELETE FROM story_organizer WHERE story_id = $1 AND user_id = $2", storyID, organizerID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error removing organizer", err))
+        return
+    }
+    renderStoryOrganizers(w, r, db, storyID)
+}
+
+func TransferStoryOwnershipHandler (w http.ResponseWriter, r *http.Request) {
+    username := r.PostFormValue("username")
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, userID, ok := storyFromRequest(w, r, db, true)
+    if !ok {
+        return
+    }
+
+    newOwnerID, err := GetUserIDByName(db, username)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot find user %s", username)))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting user", err))
+        return
+    }
+    if newOwnerID == userID {
+        writeError(w, r, apperror.Validation("You already own this story"))
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error transferring ownership", err))
+        return
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec("UPDATE story SET creator_id = $1 WHERE id = $2 AND creator_id = $3", newOwnerID, storyID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error transferring ownership", err))
+        return
+    }
+    _, err = tx.Exec("DELETE FROM story_organizer WHERE story_id = $1 AND user_id = $2", storyID, newOwnerID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error transferring ownership", err))
+        return
+    }
+    _, err = tx.Exec("INSERT OR IGNORE INTO story_organizer (story_id, user_id) VALUES($1, $2)", storyID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error transferring ownership", err))
+        return
+    }
+    err = tx.Commit()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error transferring ownership", err))
+        return
+    }
+
+    renderStoryDetail(w, r, db, storyID, userID, true)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+    "database/sql"
+    "log/slog"
+    "time"
+    "zmtwc/sk/internal/scheduler"
+)
+
+const reminderInterval = time.Minute
+
+// reminderLeads lists how long before the story start reminders go out, longest first.
+var reminderLeads = []time.Duration{ 24 * time.Hour, time.Hour }
+
+type dueReminder struct {
+    StoryID int64
+    StoryTitle string
+    StartTime int64
+    UserID int64
+}
+
+// StartReminders checks for due reminders every minute until the scheduler is stopped.
+func StartReminders(clock scheduler.Clock) *scheduler.Scheduler {
+    reminders := scheduler.New(clock, reminderInterval, func(now time.Time) {
+        db, err := OpenDB()
+        if err != nil {
+            slog.Error("Error connecting to database", "error", err)
+            return
+        }
+
+        _, err = SendDueReminders(db, now)
+        if err != nil {
+            slog.Error("Error sending reminders", "error", err)
+        }
+    })
+    reminders.Start()
+    watchWorker("reminders", reminders.Running)
+    return reminders
+}
+
+// SendDueReminders queues the reminders that are due at the given time and
+// returns how many were queued. Every reminder is stored in story_reminder
+// before it is queued, so it is never sent twice, not even after a restart.
+// A reminder that was missed while the server was down is only sent while it
+// is still the latest one due, so a late start does not produce a burst of mails.
+func SendDueReminders(db *sql.DB, now time.Time) (int, error) {
+    sent := 0
+    for i, lead := range reminderLeads {
+        nextLead := time.Duration(0)
+        if i + 1 < len(reminderLeads) {
+            nextLead = reminderLeads[i + 1]
+        }
+        due, err := getDueReminders(db, int64(lead.Seconds()), now.Add(nextLead).Unix(), now.Add(lead).Unix())
+        if err != nil {
+            return sent, err
+        }
+
+        for _, reminder := range due {
+            result, err := db.Exec(
+                "INSERT OR IGNORE INTO story_reminder (story_id, user_id, lead, start_time, sent_at) VALUES($1, $2, $3, $4, $5)",
+                reminder.StoryID, reminder.UserID, int64(lead.Seconds()), reminder.StartTime, now.Unix(),
+            )
+            if err != nil {
+                return sent, err
+            }
+            rowsAffected, err := result.RowsAffected()
+            if err != nil {
+                return sent, err
+            }
+            if rowsAffected != 1 {
+                continue
+            }
+
+            joined, err := getJoinedTasks(db, reminder.UserID, reminder.StoryID)
+            if err != nil {
+                return sent, err
+            }
+            taskNames := []string{}
+            for _, row := range joined {
+                taskNames = append(taskNames, row.TaskName)
+            }
+            notifyUsers(db, NotificationReminders, []int64{ reminder.UserID }, 0, "reminder", NotificationData{
+                StoryID: reminder.StoryID,
+                StoryTitle: reminder.StoryTitle,
+                StartTime: time.Unix(reminder.StartTime, 0).Format(DisplayTimeFormat),
+                TaskNames: taskNames,
+            })
+            sent++
+        }
+    }
+    return sent, nil
+}
+
+// getDueReminders lists participants of stories starting in (from, to] that did not get the reminder yet.
+func getDueReminders(db *sql.DB, lead int64, from int64, to int64) ([]dueReminder, error) {
+    rows, err := db.Query(`
+        SELECT DISTINCT story.id, story.title, story.start_time, assignment.assignee_id
+        FROM assignment
+        JOIN task ON task.id = assignment.task_id
+        JOIN story ON story.id = task.story_id
+        WHERE story.status > 0
+        AND story.start_time > $1
+        AND story.start_time <= $2
+        AND NOT EXISTS (
+            SELECT 1 FROM story_reminder
+            WHERE story_reminder.story_id = story.id
+            AND story_reminder.user_id = assignment.assignee_id
+            AND story_reminder.lead = $3
+            AND story_reminder.start_time = story.start_time
+        )
+        `,
+        from,
+        to,
+        lead,
+    )
+    if err != nil {
+        return []dueReminder{}, err
+    }
+    defer rows.Close()
+
+    due := []dueReminder{}
+    for rows.Next() {
+        var reminder dueReminder
+        var titleOption sql.NullString
+        err = rows.Scan(&reminder.StoryID, &titleOption, &reminder.StartTime, &reminder.UserID)
+        if err != nil {
+            return []dueReminder{}, err
+        }
+        reminder.StoryTitle = titleOption.String
+        due = append(due, reminder)
+    }
+    return due, nil
+}
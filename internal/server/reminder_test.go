@@ -0,0 +1,145 @@
+package server
+
+import (
+    "database/sql"
+    "testing"
+    "time"
+    "zmtwc/sk/internal/scheduler"
+)
+
+// setupReminderStory creates a story starting in two days with one participant,
+// on a manual clock that only moves when the test advances it.
+func setupReminderStory(t *testing.T) (*sql.DB, *scheduler.ManualClock, int64, int64) {
+    db := openTestDB(t)
+    err := LoadTemplates()
+    if err != nil {
+        t.Fatal(err)
+    }
+    clock := scheduler.NewManualClock(time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC))
+    start := clock.Now().Add(48 * time.Hour)
+
+    organizerID := createTestUser(t, db, "organizer")
+    participantID := createTestUser(t, db, "participant")
+    storyID := mustExec(t, db, "INSERT INTO story (title, creator_id, status, start_time) VALUES('Story', $1, 1, $2)", organizerID, start.Unix())
+    taskID := mustExec(t, db, "INSERT INTO task (story_id, name, slots) VALUES($1, 'Task', 2)", storyID)
+    mustExec(t, db, "INSERT INTO assignment (task_id, assignee_id) VALUES($1, $2)", taskID, participantID)
+    return db, clock, storyID, participantID
+}
+
+func TestSendDueReminders(t *testing.T) {
+    db, clock, _, participantID := setupReminderStory(t)
+
+    expectSent := func(step string, want int) {
+        t.Helper()
+        sent, err := SendDueReminders(db, clock.Now())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if sent != want {
+            t.Errorf("%s: sent %d reminders, want %d", step, sent, want)
+        }
+    }
+
+    expectSent("two days before", 0)
+    clock.Advance(24 * time.Hour - time.Minute)
+    expectSent("just before a day before", 0)
+    clock.Advance(time.Minute)
+    expectSent("a day before", 1)
+    expectSent("a day before, checked again", 0)
+
+    // the sent reminders are stored, so a restarted server does not send them again
+    clock.Advance(30 * time.Minute)
+    expectSent("after a restart", 0)
+
+    clock.Advance(23 * time.Hour - 30 * time.Minute - time.Minute)
+    expectSent("just before an hour before", 0)
+    clock.Advance(time.Minute)
+    expectSent("an hour before", 1)
+    clock.Advance(time.Hour)
+    expectSent("at the start", 0)
+
+    var notifications int
+    err := db.QueryRow("SELECT COUNT(*) FROM notification WHERE user_id = $1 AND kind = $2", participantID, NotificationReminders).Scan(&notifications)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if notifications != 2 {
+        t.Errorf("participant got %d reminders, want 2", notifications)
+    }
+}
+
+func TestSendDueRemindersAfterDowntime(t *testing.T) {
+    db, clock, storyID, participantID := setupReminderStory(t)
+
+    // the server was down over both reminder points, only the latest one is sent
+    clock.Advance(48 * time.Hour - 30 * time.Minute)
+    sent, err := SendDueReminders(db, clock.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sent != 1 {
+        t.Fatalf("sent %d reminders after the downtime, want 1", sent)
+    }
+    var lead int64
+    err = db.QueryRow("SELECT lead FROM story_reminder WHERE story_id = $1 AND user_id = $2", storyID, participantID).Scan(&lead)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if lead != int64(time.Hour.Seconds()) {
+        t.Errorf("sent the reminder %d seconds ahead, want the one an hour ahead", lead)
+    }
+}
+
+func TestReminderSchedulerOnManualClock(t *testing.T) {
+    db, clock, _, participantID := setupReminderStory(t)
+
+    // a scheduler has run its job once it waits on the clock again
+    waitForTimers := func(want int) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for clock.Waiting() != want {
+            if time.Now().After(deadline) {
+                t.Fatalf("%d timers wait on the clock, want %d", clock.Waiting(), want)
+            }
+            time.Sleep(time.Millisecond)
+        }
+    }
+    expectReminders := func(step string, want int) {
+        t.Helper()
+        var reminders int
+        err := db.QueryRow("SELECT COUNT(*) FROM notification WHERE user_id = $1 AND kind = $2", participantID, NotificationReminders).Scan(&reminders)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if reminders != want {
+            t.Errorf("%s: participant got %d reminders, want %d", step, reminders, want)
+        }
+    }
+
+    reminders := StartReminders(clock)
+    waitForTimers(1)
+    expectReminders("two days before", 0)
+    clock.Advance(24 * time.Hour - reminderInterval)
+    waitForTimers(1)
+    expectReminders("a minute before a day before", 0)
+    clock.Advance(reminderInterval)
+    waitForTimers(1)
+    expectReminders("a day before", 1)
+    clock.Advance(reminderInterval)
+    waitForTimers(1)
+    expectReminders("a minute later", 1)
+
+    // the stopped scheduler leaves its timer behind, the restarted one adds its own
+    reminders.Stop()
+    reminders = StartReminders(clock)
+    defer reminders.Stop()
+    waitForTimers(2)
+    expectReminders("after a restart", 1)
+
+    clock.Advance(23 * time.Hour - reminderInterval)
+    waitForTimers(1)
+    expectReminders("an hour before", 2)
+    clock.Advance(reminderInterval)
+    waitForTimers(1)
+    expectReminders("a minute later", 2)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    htmltemplate "html/template"
+    "io"
+    "io/fs"
+    "log/slog"
+    "net/http"
+    "os"
+    "path"
+    "sync"
+    texttemplate "text/template"
+    "time"
+    "zmtwc/sk/app"
+    "zmtwc/sk/internal/apperror"
+)
+
+// templateSets lists the files every page is parsed from. They are kept apart
+// because task-list-element-view.html overrides the controls block that
+// task-list-element.html leaves empty for the other pages.
+var templateSets = map[string][]string{
+    "landing": { "index.html", "create-story.html", "error.html", "spinner.html" },
+    "login": { "login.html", "error.html", "spinner.html" },
+    "register": { "register.html", "error.html", "spinner.html" },
+    "error": { "error.html" },
+    "header": { "header.html" },
+    "story-list": { "story-list.html", "story-list-element.html", "spinner.html" },
+    "story-detail": { "story-detail.html", "task-list-element-view.html", "task-list-element.html", "comments.html", "spinner.html" },
+    "story-edit": { "story-detail.html", "create-story.html", "spinner.html" },
+    "story-view": { "story-detail.html", "spinner.html" },
+    "create-story": { "create-story.html", "spinner.html" },
+    "task": { "task-list-element.html", "spinner.html" },
+    "task-view": { "task-list-element-view.html", "task-list-element.html", "spinner.html" },
+    "task-import": { "task-import.html", "task-list-element.html", "spinner.html" },
+    "comments": { "comments.html", "spinner.html" },
+    "story-sharing": { "story-sharing.html", "spinner.html" },
+    "story-organizers": { "story-organizers.html", "spinner.html" },
+    "story-checkin": { "story-checkin.html", "spinner.html" },
+    "story-webhooks": { "story-webhooks.html", "spinner.html" },
+    "calendar": { "calendar.html", "spinner.html" },
+    "notifications": { "notifications.html", "spinner.html" },
+    "inbox": { "inbox.html", "spinner.html" },
+}
+
+type templateCache struct {
+    mu sync.RWMutex
+    pages map[string]*htmltemplate.Template
+    emails map[string]*texttemplate.Template
+    parsedAt time.Time
+}
+
+var templates templateCache
+
+// templateFiles are the embedded templates, or the files in the template
+// directory in development mode so changes show up without a rebuild.
+func templateFiles() fs.FS {
+    if settings.DevMode {
+        return os.DirFS(settings.TemplateDir)
+    }
+    files, err := fs.Sub(app.Templates, "templates")
+    if err != nil {
+        panic(err)
+    }
+    return files
+}
+
+// LoadTemplates parses every page and mail template once, a broken template
+// stops the server from starting instead of failing requests later.
+func LoadTemplates() error {
+    templates.mu.Lock()
+    defer templates.mu.Unlock()
+    return templates.parse(templateFiles())
+}
+
+func (c *templateCache) parse(files fs.FS) error {
+    parsedAt := time.Now()
+    pages := map[string]*htmltemplate.Template{}
+    for name, set := range templateSets {
+        page, err := htmltemplate.ParseFS(files, set...)
+        if err != nil {
+            return err
+        }
+        pages[name] = page
+    }
+
+    emails := map[string]*texttemplate.Template{}
+    emailFiles, err := fs.Glob(files, "email/*.txt")
+    if err != nil {
+        return err
+    }
+    for _, file := range emailFiles {
+        email, err := texttemplate.ParseFS(files, file)
+        if err != nil {
+            return err
+        }
+        emails[path.Base(file)] = email
+    }
+
+    c.pages = pages
+    c.emails = emails
+    c.parsedAt = parsedAt
+    return nil
+}
+
+// changedSince tells whether any template file was modified after the time.
+func changedSince(files fs.FS, parsedAt time.Time) bool {
+    changed := false
+    fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+            return nil
+        }
+        info, err := entry.Info()
+        if err == nil && info.ModTime().After(parsedAt) {
+            changed = true
+            return fs.SkipAll
+        }
+        return nil
+    })
+    return changed
+}
+
+// reloadChanged parses the templates again in development mode when a file changed.
+func (c *templateCache) reloadChanged() {
+    if !settings.DevMode {
+        return
+    }
+    files := templateFiles()
+    c.mu.RLock()
+    changed := changedSince(files, c.parsedAt)
+    c.mu.RUnlock()
+    if !changed {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    err := c.parse(files)
+    if err != nil {
+        // keep serving the last good templates until the file is fixed
+        slog.Error("Error reloading templates", "error", err)
+        c.parsedAt = time.Now()
+        return
+    }
+    slog.Info("Reloaded templates")
+}
+
+// executeTemplate runs the named template of the page set into w.
+func executeTemplate(w io.Writer, set string, name string, data any) error {
+    templates.reloadChanged()
+    templates.mu.RLock()
+    page, ok := templates.pages[set]
+    templates.mu.RUnlock()
+    if !ok {
+        return fmt.Errorf("Unknown template set %s", set)
+    }
+    return page.ExecuteTemplate(w, name, data)
+}
+
+func executeEmailTemplate(w io.Writer, name string, data any) error {
+    templates.reloadChanged()
+    templates.mu.RLock()
+    email, ok := templates.emails[name + ".txt"]
+    templates.mu.RUnlock()
+    if !ok {
+        return fmt.Errorf("Unknown mail template %s", name)
+    }
+    return email.Execute(w, data)
+}
+
+// renderTemplate writes the page only once it is complete, so a template error
+// ends in a clean 500 instead of half a page.
+func renderTemplate(w http.ResponseWriter, r *http.Request, set string, name string, data any) {
+    var buffer bytes.Buffer
+    err := executeTemplate(&buffer, set, name, data)
+    if err != nil {
+        writeError(w, r, apperror.Internal(fmt.Sprintf("Error building template %s", name), err))
+        return
+    }
+    buffer.WriteTo(w)
+}
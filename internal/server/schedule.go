@@ -0,0 +1,201 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/ical"
+
+    "github.com/gorilla/mux"
+)
+
+const DisplayTimeFormat = "02. 01. 2006 15:04"
+const InputTimeFormat = "2006-01-02T15:04"
+
+// parseOptionalTime reads the unix seconds the forms send, or a local time
+// like the datetime inputs hold when the page could not convert it.
+func parseOptionalTime(value string) (sql.NullInt64, error) {
+    if value == "" {
+        return sql.NullInt64{}, nil
+    }
+    unix, err := strconv.ParseInt(value, 10, 64)
+    if err == nil {
+        return sql.NullInt64{ Int64: unix, Valid: true }, nil
+    }
+    parsed, err := time.ParseInLocation(InputTimeFormat, value, time.Local)
+    if err != nil {
+        return sql.NullInt64{}, fmt.Errorf("%s is not a time like %s", value, InputTimeFormat)
+    }
+    return sql.NullInt64{ Int64: parsed.Unix(), Valid: true }, nil
+}
+
+func formatOptionalTime(value sql.NullInt64, layout string) string {
+    if !value.Valid {
+        return ""
+    }
+    return time.Unix(value.Int64, 0).Format(layout)
+}
+
+func formatTimeWindow(start sql.NullInt64, end sql.NullInt64) string {
+    if start.Valid && end.Valid {
+        endLayout := DisplayTimeFormat
+        if time.Unix(start.Int64, 0).Format("20060102") == time.Unix(end.Int64, 0).Format("20060102") {
+            endLayout = "15:04"
+        }
+        return formatOptionalTime(start, DisplayTimeFormat) + " - " + formatOptionalTime(end, endLayout)
+    }
+    if start.Valid {
+        return "from " + formatOptionalTime(start, DisplayTimeFormat)
+    }
+    if end.Valid {
+        return "until " + formatOptionalTime(end, DisplayTimeFormat)
+    }
+    return ""
+}
+
+// setTaskWindow fills in the display and form values of the task time window.
+func setTaskWindow(task *Task, start sql.NullInt64, end sql.NullInt64) {
+    task.StartTimeInput = formatOptionalTime(start, InputTimeFormat)
+    task.EndTimeInput = formatOptionalTime(end, InputTimeFormat)
+    task.TimeWindow = formatTimeWindow(start, end)
+}
+
+// validateTaskWindow returns a user facing message when the task time window
+// is inconsistent or does not fit into the story, or an empty string when it is valid.
+func validateTaskWindow(db *sql.DB, storyID int64, start sql.NullInt64, end sql.NullInt64) (string, error) {
+    if start.Valid && end.Valid && end.Int64 <= start.Int64 {
+        return "Task has to end after it starts", nil
+    }
+
+    row := db.QueryRow("SELECT start_time, end_time FROM story WHERE id = $1", storyID)
+    var storyStart sql.NullInt64
+    var storyEnd sql.NullInt64
+    err := row.Scan(&storyStart, &storyEnd)
+    if err != nil {
+        return "", err
+    }
+    if storyStart.Valid {
+        if start.Valid && start.Int64 < storyStart.Int64 {
+            return "Task cannot start before the story", nil
+        }
+        if end.Valid && end.Int64 <= storyStart.Int64 {
+            return "Task cannot end before the story starts", nil
+        }
+    }
+    if storyEnd.Valid {
+        if end.Valid && end.Int64 > storyEnd.Int64 {
+            return "Task cannot end after the story", nil
+        }
+        if start.Valid && start.Int64 >= storyEnd.Int64 {
+            return "Task cannot start after the story ends", nil
+        }
+    }
+    return "", nil
+}
+
+// findTaskOutsideStory returns the name of a task that would not fit into the
+// given story time window, or an empty string when all of them do.
+func findTaskOutsideStory(db *sql.DB, storyID int64, start int64, end sql.NullInt64) (string, error) {
+    row := db.QueryRow(`
+        SELECT task.name
+        FROM task
+        WHERE task.story_id = $1
+        AND (
+            task.start_time < $2
+            OR task.end_time <= $2
+            OR ($3 IS NOT NULL AND (task.end_time > $3 OR task.start_time >= $3))
+        )
+        LIMIT 1
+        `,
+        storyID,
+        start,
+        end,
+    )
+    var name string
+    err := row.Scan(&name)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    return name, err
+}
+
+func TaskCalendarHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, _ := auth.ValidateSession(db, r);
+    storyID, err := GetTaskStoryID(db, taskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    canView, err := CanViewStory(db, storyID, userID, r.URL.Query().Get("key"))
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+
+    row := db.QueryRow(`
+        SELECT
+            task.name,
+            task.description,
+            story.title,
+            COALESCE(task.start_time, story.start_time),
+            COALESCE(task.end_time, story.end_time)
+        FROM task
+        JOIN story ON story.id = task.story_id
+        WHERE task.id = $1
+        `,
+        taskID,
+    )
+    var name string
+    var description string
+    var storyTitle string
+    var start sql.NullInt64
+    var end sql.NullInt64
+    err = row.Scan(&name, &description, &storyTitle, &start, &end)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    if !start.Valid {
+        writeError(w, r, apperror.NotFound("Task has no time set yet"))
+        return
+    }
+    startTime, endTime := eventTimes(start.Int64, end)
+    writeCalendar(w, r, fmt.Sprintf("task-%d.ics", taskID), ical.Calendar{
+        Name: storyTitle,
+        Events: []ical.Event{{
+            UID: ical.EventUID("task", taskID),
+            Summary: fmt.Sprintf("%s: %s", storyTitle, name),
+            Description: description,
+            Start: startTime,
+            End: endTime,
+        }},
+    })
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+    "database/sql"
+    "time"
+)
+
+// Seed creates an organizer with a published story starting tomorrow morning
+// and a volunteer who already joined one of its tasks, both with the given password.
+func Seed(db *sql.DB, password string) (int64, int64, error) {
+    organizerID, err := CreateUser(db, "organizer", password, "")
+    if err != nil {
+        return 0, 0, err
+    }
+    volunteerID, err := CreateUser(db, "volunteer", password, "")
+    if err != nil {
+        return 0, 0, err
+    }
+
+    now := time.Now()
+    start := time.Date(now.Year(), now.Month(), now.Day() + 1, 9, 0, 0, 0, time.Local)
+    end := start.Add(4 * time.Hour)
+    result, err := db.Exec(
+        "INSERT INTO story (title, description, start_time, end_time, creator_id, status, visibility) VALUES($1, $2, $3, $4, $5, 1, $6)",
+        "Community garden cleanup", "Bring gloves, we provide the tools and lunch.", start.Unix(), end.Unix(), organizerID, VisibilityPublic,
+    )
+    if err != nil {
+        return 0, 0, err
+    }
+    storyID, err := result.LastInsertId()
+    if err != nil {
+        return 0, 0, err
+    }
+
+    taskIDs, err := insertImportedTasks(db, storyID, []importedTask{
+        { Name: "Set up tools", Slots: 2, Section: "Morning", Start: sql.NullInt64{ Int64: start.Unix(), Valid: true }, End: sql.NullInt64{ Int64: start.Add(time.Hour).Unix(), Valid: true } },
+        { Name: "Weeding", Description: "The vegetable beds", Slots: 6, Section: "Morning" },
+        { Name: "Cook lunch", Slots: 2, Section: "Lunch", Group: "kitchen" },
+        { Name: "Wash up", Slots: 2, Section: "Lunch", Group: "kitchen" },
+    })
+    if err != nil {
+        return 0, 0, err
+    }
+    err = joinTask(db, taskIDs[1], volunteerID, false)
+    if err != nil {
+        return 0, 0, err
+    }
+    return organizerID, volunteerID, nil
+}
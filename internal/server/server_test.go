@@ -0,0 +1,76 @@
+package server
+
+import (
+    "database/sql"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/config"
+
+    "github.com/gorilla/mux"
+)
+
+// openTestDB points the shared pool at a new database in a temporary
+// directory, created from init.sql, and closes it when the test is done.
+func openTestDB(t *testing.T) *sql.DB {
+    t.Helper()
+    schema, err := os.ReadFile(filepath.Join("..", "..", "init.sql"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    Configure(config.Config{ DBPath: filepath.Join(t.TempDir(), "test.db") })
+    err = OpenPool()
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        ClosePool()
+        pool = nil
+    })
+    _, err = Migrate(pool, string(schema))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return pool
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...any) int64 {
+    t.Helper()
+    result, err := db.Exec(query, args...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return id
+}
+
+func createTestUser(t *testing.T, db *sql.DB, name string) int64 {
+    t.Helper()
+    return mustExec(t, db, "INSERT INTO user (username, password, email) VALUES($1, 'x', $2)", name, name + "@example.com")
+}
+
+// serveTestRequest calls the handler with the route variables set, logged in
+// as the user unless userID is 0. Errors are asked for as JSON so tests can
+// check them without the error template.
+func serveTestRequest(t *testing.T, db *sql.DB, handler http.HandlerFunc, method string, target string, vars map[string]string, userID int64) *httptest.ResponseRecorder {
+    t.Helper()
+    request := httptest.NewRequest(method, target, nil)
+    request.Header.Set("Accept", "application/json")
+    if userID != 0 {
+        sessionID, err := auth.GenerateSessionID(db, userID, time.Hour)
+        if err != nil {
+            t.Fatal(err)
+        }
+        request.Header.Set("Cookie", "session-id:" + sessionID)
+    }
+    recorder := httptest.NewRecorder()
+    handler(recorder, mux.SetURLVars(request, vars))
+    return recorder
+}
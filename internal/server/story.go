@@ -1,890 +1,1373 @@
-package server
-
-import (
-	"database/sql"
-	"fmt"
-	"html/template"
-	"net/http"
-	"strconv"
-	"time"
-	"zmtwc/sk/internal/auth"
-
-	"github.com/gorilla/mux"
-)
-
-type Story struct {
-    ID int64
-    Title string
-    StartTime string
-    Description string
-    Creator string
-    IsStoryOwner bool
-}
-
-type StoryDetail struct {
-    IsUserLoggedIn bool
-    Story Story
-    Tasks []Task
-}
-
-type Task struct {
-    IsUserLoggedIn bool
-    IsStoryOwner bool
-    HasJoined bool
-    ID int64
-    Name string
-    Description string
-    SlotsTotal int64
-    SlotsAssigned int64
-    AssignmentList []Assignments
-}
-
-type Assignments struct {
-    ID int64
-    AssigneeID int64
-    AssigneeName string
-}
-
-func GetTaskAssignments (db *sql.DB, taskID int64, userID int64) ([]Assignments, bool, error) {
-    assignments := []Assignments{}
-    rows, err := db.Query(`
-        SELECT
-            assignment.id,
-            assignment.assignee_id,
-            user.username
-        FROM assignment
-        JOIN user ON assignment.assignee_id = user.id
-        WHERE assignment.task_id = $1
-        `,
-        taskID,
-    )
-    if err != nil {
-        return []Assignments{}, false, err
-    }
-    defer rows.Close()
-
-    hasJoined := false
-    for rows.Next() {
-        var id int64
-        var assigneeID int64
-        var assigneeName string
-
-        err = rows.Scan(&id, &assigneeID, &assigneeName)
-        if err != nil {
-            return []Assignments{}, false, err
-        }
-        hasJoined = hasJoined || assigneeID == userID
-
-        assignments = append(assignments, Assignments {
-            ID: id,
-            AssigneeID: assigneeID,
-            AssigneeName: assigneeName,
-        })
-    }
-
-    return assignments, hasJoined, nil
-}
-
-func GetSingleTask (db *sql.DB, taskID int64, userID int64) (Task, error) {
-    row := db.QueryRow(`
-        SELECT
-            task.id,
-            task.name,
-            task.description,
-            task.slots,
-            story.creator_id
-        FROM task
-        JOIN story ON task.story_id = story.id
-        WHERE task.id = $1
-        `,
-        taskID,
-    )
-
-    var id int64
-    var name string
-    var storyOwnerID int64
-    var description string
-    var slots int64
-    err := row.Scan(&id, &name, &description, &slots, &storyOwnerID)
-    if err != nil {
-        return Task{}, err
-    }
-    assignments, hasJoined, err := GetTaskAssignments(db, id, userID)
-    if err != nil {
-        return Task{}, err
-    }
-
-    task := Task {
-        ID: id,
-        SlotsTotal: slots,
-        SlotsAssigned: int64(len(assignments)),
-        Description: description,
-        Name: name,
-        HasJoined: hasJoined,
-        AssignmentList: assignments,
-        IsStoryOwner: storyOwnerID == userID,
-    }
-
-    return task, nil
-}
-
-func GetStoryTasks (db *sql.DB, storyID int64, userID int64, isStoryOwner bool, isUserLoggedIn bool) ([]Task, error) {
-    tasks := []Task{}
-    rows, err := db.Query(`
-        SELECT
-            task.id,
-            task.name,
-            task.description,
-            task.slots
-        FROM task
-        WHERE task.story_id = $1
-        `,
-        storyID,
-    )
-    if err != nil {
-        return []Task{}, err
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        var id int64
-        var name string
-        var description string
-        var slots int64
-
-        err = rows.Scan(&id, &name, &description, &slots)
-        if err != nil {
-            return []Task{}, err
-        }
-
-        assignments, hasJoined, err := GetTaskAssignments(db, id, userID)
-        if err != nil {
-            return []Task{}, err
-        }
-
-        tasks = append(tasks, Task {
-            ID: id,
-            SlotsTotal: slots,
-            SlotsAssigned: int64(len(assignments)),
-            Description: description,
-            Name: name,
-            IsStoryOwner: isStoryOwner,
-            IsUserLoggedIn: isUserLoggedIn,
-            HasJoined: hasJoined,
-            AssignmentList: assignments,
-        })
-    }
-
-    return tasks, nil
-}
-
-func GetStoryData(db *sql.DB, storyID int64, userID int64) (Story, error) {
-    row := db.QueryRow(`
-        SELECT
-            story.id,
-            story.title,
-            user.username,
-            story.creator_id,
-            story.description,
-            story.start_time
-        FROM story
-        JOIN user on story.creator_id = user.id
-        WHERE story.status > 0
-        AND story.id = $1
-        `,
-        storyID,
-    )
-
-    var id int64
-    var title string
-    var creatorName string
-    var creatorID int64
-    var descriptionOption sql.NullString
-    var startTimeOption sql.NullInt64
-
-    err := row.Scan(&id, &title, &creatorName, &creatorID, &descriptionOption, &startTimeOption)
-    if err != nil {
-        return Story{}, err
-    }
-
-    description := ""
-    if descriptionOption.Valid {
-        description = descriptionOption.String
-    }
-    startTime := ""
-    if startTimeOption.Valid {
-        startTime = time.Unix(startTimeOption.Int64, 0).Format("02. 01. 2006 15:04")
-    }
-
-    return Story{
-        ID: id,
-        Title: title,
-        Description: description,
-        StartTime: startTime,
-        Creator: creatorName,
-        IsStoryOwner: creatorID == userID,
-    }, nil
-}
-
-type StoryEditPageData struct {
-    ID int64
-    Title string
-    StartTime string
-    Description string
-}
-
-func StoryEditPageHandler (w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400)
-        return
-    }
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    _, _, err = auth.ValidateSession(db, r);
-    if err != nil {
-        http.Error(w, "Cannot find valid session", 401)
-        return
-    }
-    row := db.QueryRow(`
-        SELECT
-            story.id,
-            story.title,
-            story.description,
-            story.start_time
-        FROM story
-        WHERE story.id = $1`,
-        storyID,
-    )
-
-    var id int64
-    var title string
-    var descriptionOption sql.NullString
-    var startTime int64
-
-    err = row.Scan(&id, &title, &descriptionOption, &startTime)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error loading data from database: %s", err), 500)
-        return
-    }
-
-    description := ""
-    if descriptionOption.Valid {
-        description = descriptionOption.String
-    }
-    startTimeString := time.Unix(startTime, 0).Format("2006-01-02T15:04")
-
-    tmpl := template.Must(template.ParseFiles("app/templates/story-detail.html", "app/templates/create-story.html", "app/templates/spinner.html"))
-    err = tmpl.ExecuteTemplate(w, "story-detail-edit", StoryEditPageData {
-        ID: id,
-        Title: title,
-        Description: description,
-        StartTime: startTimeString,
-    })
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func StoryDetailHandler (w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400)
-        return
-    }
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    userID, _, sessionErr := auth.ValidateSession(db, r);
-
-    story, err := GetStoryData(db, storyID, userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting story: %s", err), 500)
-        return
-    }
-    isUserLoggedIn := sessionErr == nil
-    tasks, err := GetStoryTasks(db, storyID, userID, story.IsStoryOwner, isUserLoggedIn)
-
-    tmpl := template.Must(template.ParseFiles("app/templates/story-detail.html", "app/templates/task-list-element-view.html", "app/templates/task-list-element.html", "app/templates/spinner.html"))
-    err = tmpl.Execute(w, StoryDetail {
-        IsUserLoggedIn: isUserLoggedIn,
-        Story: story,
-        Tasks: tasks,
-    })
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-type StoryListData struct {
-    Stories []Story
-    IsUserLoggedIn bool
-}
-
-func StoryListHandler (w http.ResponseWriter, r *http.Request) {
-    stories := []Story{}
-
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    userID, _, sessionErr := auth.ValidateSession(db, r);
-
-    rows, err := db.Query(`
-        SELECT
-            story.id,
-            story.title,
-            user.username,
-            story.creator_id,
-            story.description,
-            story.start_time
-        FROM story
-        JOIN user on story.creator_id = user.id
-        WHERE story.status > 0
-    `)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting story list: %s", err), 500)
-        return
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        var id int64
-        var title string
-        var creatorName string
-        var creatorID int64
-        var descriptionOption sql.NullString
-        var startTimeOption sql.NullInt64
-
-        err = rows.Scan(&id, &title, &creatorName, &creatorID, &descriptionOption, &startTimeOption)
-        if err != nil {
-            http.Error(w, fmt.Sprintf("Error getting story entries: %s", err), 500)
-            return
-        }
-
-        description := ""
-        if descriptionOption.Valid {
-            description = descriptionOption.String
-        }
-        startTime := ""
-        if startTimeOption.Valid {
-            startTime = time.Unix(startTimeOption.Int64, 0).Format("02. 01. 2006 15:04")
-        }
-
-        isStoryOwner := sessionErr == nil && userID == creatorID
-        stories = append(stories, Story {
-            ID: id,
-            Title: title,
-            Description: description,
-            StartTime: startTime,
-            Creator: creatorName,
-            IsStoryOwner: isStoryOwner,
-        })
-    }
-
-    tmpl := template.Must(template.ParseFiles("app/templates/story-list.html", "app/templates/story-list-element.html", "app/templates/spinner.html"))
-    tmpl.Execute(w, StoryListData{ Stories: stories, IsUserLoggedIn: sessionErr == nil })
-}
-
-type CreateStoryPageData struct {
-    StoryID int64
-    Title string
-    StartTime string
-    Description string
-    Tasks []Task
-}
-
-func CreateStoryPage (w http.ResponseWriter, r *http.Request) {
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    userID, _, err := auth.ValidateSession(db, r);
-    if err != nil {
-        http.Error(w, "Cannot find valid session", 401)
-        return
-    }
-
-    _, err = db.Exec("DELETE FROM assignment WHERE task_id IN (SELECT task.id FROM task JOIN story ON story.id = task.story_id AND story.creator_id = $1 AND status = 0)", userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error cleaning up draft stories: %s", err), 500)
-        return
-    }
-    _, err = db.Exec("DELETE FROM task WHERE story_id IN (SELECT story.id FROM story WHERE creator_id = $1 AND status = 0)", userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error cleaning up draft stories: %s", err), 500)
-        return
-    }
-    _, err = db.Exec("DELETE FROM story WHERE creator_id = $1 AND status = 0", userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error cleaning up draft stories: %s", err), 500)
-        return
-    }
-
-    result, err := db.Exec("INSERT INTO story (creator_id, status) VALUES($1, $2)", userID, 0)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error creating story draft: %s", err), 500)
-        return
-    }
-
-    storyID, err := result.LastInsertId()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error creating story draft: %s", err), 500)
-        return
-    }
-
-    tasks, err := GetTasks(db)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting task: %s", err), 500)
-        return
-    }
-
-    tmpl := template.Must(template.ParseFiles("app/templates/create-story.html", "app/templates/spinner.html"))
-    err = tmpl.Execute(w, CreateStoryPageData { StoryID: storyID, Tasks: tasks })
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func createTaskToStoryHandler (r *http.Request) (Task, string, int) {
-    vars := mux.Vars(r)
-    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        return Task{}, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400
-    }
-    name := r.PostFormValue("name")
-    description := r.PostFormValue("description")
-    slots, err := strconv.ParseInt(r.PostFormValue("slots"), 10, 64)
-    if err != nil {
-        return Task{}, fmt.Sprintf("Cannot parse value %s as integer: %s", r.PostFormValue("slots"), err), 400
-    }
-
-    db, err := OpenDB()
-    if err != nil {
-        return Task{}, fmt.Sprintf("Error connecting to database: %s", err), 500
-    }
-    defer db.Close()
-    _, _, err = auth.ValidateSession(db, r);
-    if err != nil {
-        return Task{}, "Cannot find valid session", 401
-    }
-
-    result, err := db.Exec("INSERT INTO task (story_id, name, description, slots) VALUES($1, $2, $3, $4)", storyID, name, description, slots)
-    if err != nil {
-        return Task{}, fmt.Sprintf("Error creating task: %s", err), 500
-    }
-
-    id, err := result.LastInsertId()
-    if err != nil {
-        return Task{}, fmt.Sprintf("Error creating task: %s", err), 500
-    }
-
-    return  Task{
-        ID: id,
-        Name: name,
-        Description: description,
-        SlotsTotal: slots,
-        SlotsAssigned: 0,
-        AssignmentList: []Assignments{},
-        HasJoined: false,
-        IsStoryOwner: true,
-        IsUserLoggedIn: true,
-    }, "", 0
-}
-
-func AddTaskToStoryFinalizeHandler (w http.ResponseWriter, r *http.Request) {
-    task, errorMsg, errorCode := createTaskToStoryHandler(r)
-    if errorCode != 0 {
-        http.Error(w, errorMsg, errorCode)
-    }
-
-    tmpl := template.Must(template.ParseFiles("app/templates/task-list-element.html", "app/templates/spinner.html"))
-    err := tmpl.ExecuteTemplate(w, "task-list-element-base", task)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func AddTaskToStoryHandler (w http.ResponseWriter, r *http.Request) {
-    task, errorMsg, errorCode := createTaskToStoryHandler(r)
-    if errorCode != 0 {
-        http.Error(w, errorMsg, errorCode)
-    }
-
-    tmpl := template.Must(template.ParseFiles("app/templates/task-list-element-view.html", "app/templates/task-list-element.html", "app/templates/spinner.html"))
-    err := tmpl.ExecuteTemplate(w, "task-list-element-view.html", task)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func ChangeStoryTaskAssignmentHandler (w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400)
-        return
-    }
-    action := r.PostFormValue("action")
-
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-    userID, _, err := auth.ValidateSession(db, r);
-    if err != nil {
-        http.Error(w, "Cannot find valid session", 401)
-        return
-    }
-
-    var result sql.Result
-    if action == "join" {
-        result, err = db.Exec("INSERT INTO assignment (task_id, assignee_id) VALUES($1, $2)", taskID, userID)
-    } else {
-        result, err = db.Exec("DELETE FROM assignment WHERE task_id = $1 AND assignee_id = $2", taskID, userID)
-    }
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error changing task assignment: %s", err), 500)
-        return
-    }
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error changing task assignment: %s", err), 500)
-        return
-    }
-    if rowsAffected != 1 {
-        http.Error(w, "Error changing task assignment: incorrect number of rows changes", 500)
-        return
-    }
-
-    task, err := GetSingleTask(db, taskID, userID)
-    task.IsUserLoggedIn = true
-
-    tmpl := template.Must(template.ParseFiles("app/templates/task-list-element-view.html", "app/templates/task-list-element.html", "app/templates/spinner.html"))
-    err = tmpl.ExecuteTemplate(w, "task-list-element-view.html", task)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func ChangeStoryTaskViewHandler (w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400)
-        return
-    }
-
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-    userID, _, err := auth.ValidateSession(db, r);
-    if err != nil {
-        http.Error(w, "Cannot find valid session", 401)
-        return
-    }
-
-    task, err := GetSingleTask(db, taskID, userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting task data: %s", err), 500)
-        return
-    }
-    task.IsUserLoggedIn = true
-
-    tmpl := template.Must(template.ParseFiles("app/templates/task-list-element.html", "app/templates/spinner.html"))
-    err = tmpl.ExecuteTemplate(w, "task-detail-edit", task)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func TaskDetailHandler (w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400)
-        return
-    }
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    userID, _, sessionErr := auth.ValidateSession(db, r);
-    task, err := GetSingleTask(db, taskID, userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting task data: %s", err), 500)
-        return
-    }
-    task.IsUserLoggedIn = sessionErr != nil
-
-    tmpl := template.Must(template.ParseFiles("app/templates/task-list-element.html", "app/templates/spinner.html"))
-    err = tmpl.ExecuteTemplate(w, "task-detail-view", task)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func ChangeTaskHandler (w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400)
-        return
-    }
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    name := r.PostFormValue("name")
-    description := r.PostFormValue("description")
-    slotsTotal, err := strconv.ParseInt(r.PostFormValue("slots"), 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", r.PostFormValue("slots"), err), 400)
-        return
-    }
-    userID, _, sessionErr := auth.ValidateSession(db, r);
-    if sessionErr != nil {
-        http.Error(w, "Cannot find valid session", 401)
-        return
-    }
-
-    result, err := db.Exec(
-        "UPDATE task SET name = $1, description = $2, slots = $3 WHERE id = $4",
-        name, description, slotsTotal, taskID,
-    )
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error updating task data: %s", err), 500)
-        return
-    }
-
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error updating task data: %s", err), 500)
-        return
-    }
-    if rowsAffected != 1 {
-        http.Error(w, fmt.Sprintf("Error updating task, incorrect numbers of rows affected: %d", rowsAffected), 500)
-        return
-    }
-
-    task, err := GetSingleTask(db, taskID, userID)
-    task.IsUserLoggedIn = true
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error getting task data: %s", err), 500)
-        return
-    }
-
-    slotsToDelete := task.SlotsAssigned - task.SlotsTotal
-    if slotsToDelete > 0 {
-        result, err := db.Exec(`
-            DELETE FROM assignment
-            WHERE task_id = $1
-            AND id NOT IN
-                (SELECT id FROM assignment WHERE task_id = $1 ORDER BY id ASC LIMIT $2)
-            `,
-            taskID,
-            slotsToDelete,
-        )
-        if err != nil {
-            http.Error(w, fmt.Sprintf("Error updating tasks slots: %s", err), 500)
-            return
-        }
-
-        rowsAffected, err := result.RowsAffected()
-        if err != nil {
-            http.Error(w, fmt.Sprintf("Error updating tasks slots: %s", err), 500)
-            return
-        }
-        if rowsAffected != slotsToDelete {
-            http.Error(w, fmt.Sprintf("Error deleting assignments due to the slots change in task: deleted %d instead of %d", rowsAffected, slotsToDelete), 500)
-            return
-        }
-
-        assignments, hasJoined, err := GetTaskAssignments(db, taskID, userID)
-        if err != nil {
-            http.Error(w, fmt.Sprintf("Error getting assignments: %s", err), 500)
-            return
-        }
-        task.HasJoined = hasJoined
-        task.AssignmentList = assignments
-        task.SlotsAssigned = int64(len(assignments))
-    }
-
-    tmpl := template.Must(template.ParseFiles("app/templates/task-list-element-view.html", "app/templates/task-list-element.html", "app/templates/spinner.html"))
-    err = tmpl.ExecuteTemplate(w, "task-list-element-view.html", task)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func DeleteStoryTaskHandler (w http.ResponseWriter, r *http.Request) {
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-    vars := mux.Vars(r)
-    id, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400)
-        return
-    }
-
-    result, err := db.Exec("DELETE FROM task WHERE id = $1", id)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error deleting task: %s", err), 500)
-        return
-    }
-
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error deleting task: %s", err), 500)
-        return
-    }
-    if rowsAffected != 1 {
-        http.Error(w, fmt.Sprintf("Error deleting story task, incorrect numbers of rows affected: %d", err), 500)
-        return
-    }
-}
-
-func updateStoryHandler (r *http.Request) (Story, string, int) {
-    vars := mux.Vars(r)
-    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
-    if err != nil {
-        return Story{}, fmt.Sprintf("Cannot parse value %s as integer: %s", vars["id"], err), 400
-    }
-    db, err := OpenDB()
-    if err != nil {
-        return Story{}, fmt.Sprintf("Error connecting to database: %s", err), 500
-
-    }
-    defer db.Close()
-    title := r.PostFormValue("title")
-    description := r.PostFormValue("description")
-    startTime, err := strconv.ParseInt(r.PostFormValue("time"), 10, 64)
-    if err != nil {
-        return Story{}, fmt.Sprintf("Cannot parse value %s as integer: %s", r.PostFormValue("time"), err), 400
-    }
-    userID, userName, sessionErr := auth.ValidateSession(db, r)
-    if sessionErr != nil {
-        return Story{}, "Cannot find valid session", 401
-    }
-
-    result, err := db.Exec(
-        "UPDATE story SET title = $1, description = $2, start_time = $3, status = 1 WHERE id = $4 AND creator_id = $5",
-        title, description, startTime, storyID, userID,
-    )
-    if err != nil {
-        return Story{}, fmt.Sprintf("Error updating story: %s", err), 500
-    }
-
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        return Story{}, fmt.Sprintf("Error updating story: %s", err), 500
-    }
-    if rowsAffected != 1 {
-        return Story{}, fmt.Sprintf("Error updating story, incorrect numbers of rows affected: %d", rowsAffected), 500
-    }
-    if err != nil {
-        return Story{}, fmt.Sprintf("Error updating story: %s", err), 500
-    }
-
-    return Story{
-        ID: storyID,
-        Title: title,
-        Description: description,
-        StartTime: time.Unix(startTime, 0).Format("02. 01. 2006 15:04"),
-        Creator: userName,
-        IsStoryOwner: true,
-    }, "", 0
-}
-
-type StoryViewPageData struct {
-    Story Story
-}
-
-func ChangeStoryHandler (w http.ResponseWriter, r *http.Request) {
-    story, errorString, errorCode := updateStoryHandler(r)
-    if errorCode != 0 {
-        http.Error(w, errorString, errorCode)
-        return
-    }
-
-    tmpl := template.Must(template.ParseFiles("app/templates/story-detail.html", "app/templates/spinner.html"))
-    err := tmpl.ExecuteTemplate(w, "story-detail-view", StoryViewPageData { Story: story })
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error building template: %s", err), 500)
-    }
-}
-
-func FinalizeCreateStoryHandler (w http.ResponseWriter, r *http.Request) {
-    _, errorString, errorCode := updateStoryHandler(r)
-    if errorCode != 0 {
-        http.Error(w, errorString, errorCode)
-        return
-    }
-
-    w.Header().Add("HX-Trigger", "reload-stories")
-}
-
-func DeleteStoryHandler(w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    id := vars["id"]
-
-    db, err := OpenDB()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error connecting to database: %s", err), 500)
-        return
-    }
-    defer db.Close()
-
-    userID, _, err := auth.ValidateSession(db, r);
-    if err != nil {
-        http.Error(w, "Cannot find valid session", 401)
-        return
-    }
-
-    result, err := db.Exec("DELETE FROM story WHERE id = $1 and creator_id = $2", id, userID)
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error deleting story: %s", err), 500)
-        return
-    }
-
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        http.Error(w, fmt.Sprintf("Error deleting story: %s", err), 500)
-        return
-    }
-    if rowsAffected != 1 {
-        http.Error(w, fmt.Sprintf("Error deleting story, incorrect number of rows affected: %d", rowsAffected), 500)
-        return
-    }
-    w.Header().Add("HX-Redirect", "/")
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"zmtwc/sk/internal/apperror"
+	"zmtwc/sk/internal/auth"
+	"zmtwc/sk/internal/webhook"
+
+	"github.com/gorilla/mux"
+)
+
+type Story struct {
+    ID int64
+    Title string
+    StartTime string
+    EndTime string
+    Description string
+    Creator string
+    IsStoryOwner bool
+    IsStoryOrganizer bool
+    CanManageWebhooks bool
+    Visibility int64
+    MaxTasksPerUser int64
+    MaxNoShows int64
+}
+
+type StoryDetail struct {
+    IsUserLoggedIn bool
+    // InviteKey is the invite link token the story was opened with, passed on
+    // to the requests of the page that check access on their own
+    InviteKey string
+    Story Story
+    Sections []TaskSection
+    Comments CommentThread
+}
+
+type Task struct {
+    IsUserLoggedIn bool
+    IsStoryOrganizer bool
+    HasJoined bool
+    ID int64
+    StoryID int64
+    Name string
+    Description string
+    SlotsTotal int64
+    SlotsAssigned int64
+    ExclusiveGroup string
+    Section string
+    Position int64
+    TimeWindow string
+    StartTimeInput string
+    EndTimeInput string
+    JoinBlockedReason string
+    IsLocked bool
+    SwapOOB bool
+    Notice string
+    AssignmentList []Assignments
+    History []AssignmentLogEntry
+    MoveTargets []TaskOption
+}
+
+type Assignments struct {
+    ID int64
+    AssigneeID int64
+    AssigneeName string
+    AssigneeEmail string
+}
+
+func GetTaskAssignments (db *sql.DB, taskID int64, userID int64) ([]Assignments, bool, error) {
+    assignments := []Assignments{}
+    rows, err := db.Query(`
+        SELECT
+            assignment.id,
+            assignment.assignee_id,
+            user.username,
+            user.email
+        FROM assignment
+        JOIN user ON assignment.assignee_id = user.id
+        WHERE assignment.task_id = $1
+        ORDER BY assignment.id ASC
+        `,
+        taskID,
+    )
+    if err != nil {
+        return []Assignments{}, false, err
+    }
+    defer rows.Close()
+
+    hasJoined := false
+    for rows.Next() {
+        var id int64
+        var assigneeID int64
+        var assigneeName string
+        var assigneeEmailOption sql.NullString
+
+        err = rows.Scan(&id, &assigneeID, &assigneeName, &assigneeEmailOption)
+        if err != nil {
+            return []Assignments{}, false, err
+        }
+        hasJoined = hasJoined || assigneeID == userID
+
+        assignments = append(assignments, Assignments {
+            ID: id,
+            AssigneeID: assigneeID,
+            AssigneeName: assigneeName,
+            AssigneeEmail: assigneeEmailOption.String,
+        })
+    }
+
+    return assignments, hasJoined, nil
+}
+
+func GetSingleTask (db *sql.DB, taskID int64, userID int64) (Task, error) {
+    row := db.QueryRow(`
+        SELECT
+            task.id,
+            task.name,
+            task.description,
+            task.slots,
+            task.exclusive_group,
+            task.section,
+            task.position,
+            task.start_time,
+            task.end_time,
+            task.locked,
+            task.story_id
+        FROM task
+        WHERE task.id = $1
+        `,
+        taskID,
+    )
+
+    var id int64
+    var name string
+    var storyID int64
+    var description string
+    var slots int64
+    var exclusiveGroupOption sql.NullString
+    var sectionOption sql.NullString
+    var positionOption sql.NullInt64
+    var startTimeOption sql.NullInt64
+    var endTimeOption sql.NullInt64
+    var locked bool
+    err := row.Scan(&id, &name, &description, &slots, &exclusiveGroupOption, &sectionOption, &positionOption, &startTimeOption, &endTimeOption, &locked, &storyID)
+    if err != nil {
+        return Task{}, err
+    }
+    isStoryOrganizer, err := IsStoryOrganizer(db, storyID, userID)
+    if err != nil {
+        return Task{}, err
+    }
+    assignments, hasJoined, err := GetTaskAssignments(db, id, userID)
+    if err != nil {
+        return Task{}, err
+    }
+
+    task := Task {
+        ID: id,
+        StoryID: storyID,
+        SlotsTotal: slots,
+        SlotsAssigned: int64(len(assignments)),
+        Description: description,
+        Name: name,
+        HasJoined: hasJoined,
+        ExclusiveGroup: exclusiveGroupOption.String,
+        Section: sectionOption.String,
+        Position: positionOption.Int64,
+        IsLocked: locked,
+        AssignmentList: assignments,
+        IsStoryOrganizer: isStoryOrganizer,
+    }
+    setTaskWindow(&task, startTimeOption, endTimeOption)
+    task.JoinBlockedReason, err = joinBlockedReason(db, task, userID)
+    if err != nil {
+        return Task{}, err
+    }
+    if isStoryOrganizer {
+        options, err := GetStoryTaskOptions(db, storyID)
+        if err != nil {
+            return Task{}, err
+        }
+        err = fillOrganizerTaskData(db, &task, options)
+        if err != nil {
+            return Task{}, err
+        }
+    }
+
+    return task, nil
+}
+
+func GetStoryTasks (db *sql.DB, storyID int64, userID int64, isStoryOrganizer bool, isUserLoggedIn bool) ([]Task, error) {
+    tasks := []Task{}
+    rows, err := db.Query(`
+        SELECT
+            task.id,
+            task.name,
+            task.description,
+            task.slots,
+            task.exclusive_group,
+            task.section,
+            task.position,
+            task.start_time,
+            task.end_time,
+            task.locked
+        FROM task
+        WHERE task.story_id = $1
+        ORDER BY task.position, task.start_time IS NULL, task.start_time, task.id
+        `,
+        storyID,
+    )
+    if err != nil {
+        return []Task{}, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var id int64
+        var name string
+        var description string
+        var slots int64
+        var exclusiveGroupOption sql.NullString
+        var sectionOption sql.NullString
+        var positionOption sql.NullInt64
+        var startTimeOption sql.NullInt64
+        var endTimeOption sql.NullInt64
+        var locked bool
+
+        err = rows.Scan(&id, &name, &description, &slots, &exclusiveGroupOption, &sectionOption, &positionOption, &startTimeOption, &endTimeOption, &locked)
+        if err != nil {
+            return []Task{}, err
+        }
+
+        assignments, hasJoined, err := GetTaskAssignments(db, id, userID)
+        if err != nil {
+            return []Task{}, err
+        }
+
+        task := Task {
+            ID: id,
+            StoryID: storyID,
+            SlotsTotal: slots,
+            SlotsAssigned: int64(len(assignments)),
+            Description: description,
+            Name: name,
+            IsStoryOrganizer: isStoryOrganizer,
+            IsUserLoggedIn: isUserLoggedIn,
+            HasJoined: hasJoined,
+            ExclusiveGroup: exclusiveGroupOption.String,
+            Section: sectionOption.String,
+            Position: positionOption.Int64,
+            IsLocked: locked,
+            AssignmentList: assignments,
+        }
+        setTaskWindow(&task, startTimeOption, endTimeOption)
+        tasks = append(tasks, task)
+    }
+
+    if isUserLoggedIn {
+        for i := range tasks {
+            tasks[i].JoinBlockedReason, err = joinBlockedReason(db, tasks[i], userID)
+            if err != nil {
+                return []Task{}, err
+            }
+        }
+    }
+
+    if isStoryOrganizer {
+        options, err := GetStoryTaskOptions(db, storyID)
+        if err != nil {
+            return []Task{}, err
+        }
+        for i := range tasks {
+            err = fillOrganizerTaskData(db, &tasks[i], options)
+            if err != nil {
+                return []Task{}, err
+            }
+        }
+    }
+
+    return tasks, nil
+}
+
+func GetStoryData(db *sql.DB, storyID int64, userID int64) (Story, error) {
+    row := db.QueryRow(`
+        SELECT
+            story.id,
+            story.title,
+            user.username,
+            story.creator_id,
+            story.description,
+            story.start_time,
+            story.end_time,
+            story.visibility,
+            story.max_tasks_per_user,
+            story.max_no_shows
+        FROM story
+        JOIN user on story.creator_id = user.id
+        WHERE story.status > 0
+        AND story.id = $1
+        `,
+        storyID,
+    )
+
+    var id int64
+    var title string
+    var creatorName string
+    var creatorID int64
+    var descriptionOption sql.NullString
+    var startTimeOption sql.NullInt64
+    var endTimeOption sql.NullInt64
+    var visibilityOption sql.NullInt64
+    var maxTasksOption sql.NullInt64
+    var maxNoShowsOption sql.NullInt64
+
+    err := row.Scan(&id, &title, &creatorName, &creatorID, &descriptionOption, &startTimeOption, &endTimeOption, &visibilityOption, &maxTasksOption, &maxNoShowsOption)
+    if err != nil {
+        return Story{}, err
+    }
+    isStoryOrganizer, err := IsStoryOrganizer(db, id, userID)
+    if err != nil {
+        return Story{}, err
+    }
+    canManageWebhooks, err := CanManageWebhooks(db, id, userID)
+    if err != nil {
+        return Story{}, err
+    }
+
+    description := ""
+    if descriptionOption.Valid {
+        description = descriptionOption.String
+    }
+    startTime := ""
+    if startTimeOption.Valid {
+        startTime = time.Unix(startTimeOption.Int64, 0).Format("02. 01. 2006 15:04")
+    }
+
+    return Story{
+        ID: id,
+        Title: title,
+        Description: description,
+        StartTime: startTime,
+        EndTime: formatOptionalTime(endTimeOption, DisplayTimeFormat),
+        Creator: creatorName,
+        IsStoryOwner: creatorID == userID,
+        IsStoryOrganizer: isStoryOrganizer,
+        CanManageWebhooks: canManageWebhooks,
+        Visibility: visibilityOption.Int64,
+        MaxTasksPerUser: maxTasksOption.Int64,
+        MaxNoShows: maxNoShowsOption.Int64,
+    }, nil
+}
+
+type StoryEditPageData struct {
+    ID int64
+    Title string
+    StartTime string
+    EndTime string
+    Description string
+    Visibility int64
+    MaxTasksPerUser int64
+    MaxNoShows int64
+}
+
+func StoryEditPageHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    row := db.QueryRow(`
+        SELECT
+            story.id,
+            story.title,
+            story.description,
+            story.start_time,
+            story.end_time,
+            story.visibility,
+            story.max_tasks_per_user,
+            story.max_no_shows
+        FROM story
+        WHERE story.id = $1`,
+        storyID,
+    )
+
+    var id int64
+    var title string
+    var descriptionOption sql.NullString
+    var startTime int64
+    var endTimeOption sql.NullInt64
+    var visibilityOption sql.NullInt64
+    var maxTasksOption sql.NullInt64
+    var maxNoShowsOption sql.NullInt64
+
+    err = row.Scan(&id, &title, &descriptionOption, &startTime, &endTimeOption, &visibilityOption, &maxTasksOption, &maxNoShowsOption)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error loading data from database", err))
+        return
+    }
+
+    description := ""
+    if descriptionOption.Valid {
+        description = descriptionOption.String
+    }
+    startTimeString := time.Unix(startTime, 0).Format("2006-01-02T15:04")
+
+    renderTemplate(w, r, "story-edit", "story-detail-edit", StoryEditPageData {
+        ID: id,
+        Title: title,
+        Description: description,
+        StartTime: startTimeString,
+        EndTime: formatOptionalTime(endTimeOption, InputTimeFormat),
+        Visibility: visibilityOption.Int64,
+        MaxTasksPerUser: maxTasksOption.Int64,
+        MaxNoShows: maxNoShowsOption.Int64,
+    })
+}
+
+func StoryDetailHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, sessionErr := auth.ValidateSession(db, r);
+
+    // opening an invite link while logged in accepts the invite, which is
+    // what gives access to invite-only stories
+    inviteToken := r.URL.Query().Get("key")
+    if sessionErr == nil && inviteToken != "" {
+        _, err = RedeemInviteLink(db, inviteToken, userID)
+        if err != nil && err != sql.ErrNoRows {
+            writeError(w, r, apperror.Internal("Error accepting invite", err))
+            return
+        }
+    }
+    canView, err := CanViewStory(db, storyID, userID, inviteToken)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView && sessionErr != nil {
+        writeError(w, r, apperror.Unauthorized("Log in to see this story"))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+
+    renderStoryDetail(w, r, db, storyID, userID, sessionErr == nil)
+}
+
+func renderStoryDetail (w http.ResponseWriter, r *http.Request, db *sql.DB, storyID int64, userID int64, isUserLoggedIn bool) {
+    story, err := GetStoryData(db, storyID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    tasks, err := GetStoryTasks(db, storyID, userID, story.IsStoryOrganizer, isUserLoggedIn)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story tasks", err))
+        return
+    }
+    comments, err := GetCommentThread(db, storyID, 0, userID, isUserLoggedIn)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting comments", err))
+        return
+    }
+
+    renderTemplate(w, r, "story-detail", "story-detail.html", StoryDetail {
+        IsUserLoggedIn: isUserLoggedIn,
+        InviteKey: r.URL.Query().Get("key"),
+        Story: story,
+        Sections: GroupTaskSections(tasks),
+        Comments: comments,
+    })
+}
+
+type StoryListData struct {
+    Stories []Story
+    IsUserLoggedIn bool
+}
+
+func StoryListHandler (w http.ResponseWriter, r *http.Request) {
+    stories := []Story{}
+
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, sessionErr := auth.ValidateSession(db, r);
+
+    rows, err := db.Query(`
+        SELECT
+            story.id,
+            story.title,
+            user.username,
+            story.creator_id,
+            story.description,
+            story.start_time
+        FROM story
+        JOIN user on story.creator_id = user.id
+        WHERE story.status > 0
+        AND (
+            story.visibility = $1
+            OR story.creator_id = $2
+            OR EXISTS (SELECT 1 FROM story_organizer WHERE story_organizer.story_id = story.id AND story_organizer.user_id = $2)
+            OR EXISTS (SELECT 1 FROM story_invitee WHERE story_invitee.story_id = story.id AND story_invitee.user_id = $2)
+        )
+        `,
+        VisibilityPublic,
+        userID,
+    )
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story list", err))
+        return
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var id int64
+        var title string
+        var creatorName string
+        var creatorID int64
+        var descriptionOption sql.NullString
+        var startTimeOption sql.NullInt64
+
+        err = rows.Scan(&id, &title, &creatorName, &creatorID, &descriptionOption, &startTimeOption)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error getting story entries", err))
+            return
+        }
+
+        description := ""
+        if descriptionOption.Valid {
+            description = descriptionOption.String
+        }
+        startTime := ""
+        if startTimeOption.Valid {
+            startTime = time.Unix(startTimeOption.Int64, 0).Format("02. 01. 2006 15:04")
+        }
+
+        isStoryOwner := sessionErr == nil && userID == creatorID
+        stories = append(stories, Story {
+            ID: id,
+            Title: title,
+            Description: description,
+            StartTime: startTime,
+            Creator: creatorName,
+            IsStoryOwner: isStoryOwner,
+        })
+    }
+
+    renderTemplate(w, r, "story-list", "story-list.html", StoryListData{ Stories: stories, IsUserLoggedIn: sessionErr == nil })
+}
+
+type CreateStoryPageData struct {
+    StoryID int64
+    Title string
+    StartTime string
+    EndTime string
+    Description string
+    Visibility int64
+    MaxTasksPerUser int64
+    MaxNoShows int64
+    Tasks []Task
+}
+
+func CreateStoryPage (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+
+    _, err = db.Exec("DELETE FROM assignment WHERE task_id IN (SELECT task.id FROM task JOIN story ON story.id = task.story_id AND story.creator_id = $1 AND status = 0)", userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error cleaning up draft stories", err))
+        return
+    }
+    _, err = db.Exec("DELETE FROM task WHERE story_id IN (SELECT story.id FROM story WHERE creator_id = $1 AND status = 0)", userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error cleaning up draft stories", err))
+        return
+    }
+    _, err = db.Exec("DELETE FROM story WHERE creator_id = $1 AND status = 0", userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error cleaning up draft stories", err))
+        return
+    }
+
+    result, err := db.Exec("INSERT INTO story (creator_id, status) VALUES($1, $2)", userID, 0)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating story draft", err))
+        return
+    }
+
+    storyID, err := result.LastInsertId()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating story draft", err))
+        return
+    }
+
+    tasks, err := GetTasks(db)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task", err))
+        return
+    }
+
+    renderTemplate(w, r, "create-story", "create-story.html", CreateStoryPageData { StoryID: storyID, Tasks: tasks })
+}
+
+func createTaskToStoryHandler (r *http.Request) (Task, error) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        return Task{}, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"]))
+    }
+    name := r.PostFormValue("name")
+    description := r.PostFormValue("description")
+    exclusiveGroup := strings.TrimSpace(r.PostFormValue("group"))
+    section := strings.TrimSpace(r.PostFormValue("section"))
+    slots, err := strconv.ParseInt(r.PostFormValue("slots"), 10, 64)
+    if err != nil {
+        return Task{}, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", r.PostFormValue("slots")))
+    }
+    if slots < 1 {
+        return Task{}, apperror.Validation("A task needs at least one slot")
+    }
+    startTime, err := parseOptionalTime(r.PostFormValue("start"))
+    if err != nil {
+        return Task{}, apperror.Validation(fmt.Sprintf("Cannot parse the start time: %s", err))
+    }
+    endTime, err := parseOptionalTime(r.PostFormValue("end"))
+    if err != nil {
+        return Task{}, apperror.Validation(fmt.Sprintf("Cannot parse the end time: %s", err))
+    }
+
+    db, err := OpenDB()
+    if err != nil {
+        return Task{}, apperror.Internal("Error connecting to database", err)
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        return Task{}, apperror.Unauthorized("Cannot find valid session")
+    }
+    isStoryOrganizer, err := IsStoryOrganizer(db, storyID, userID)
+    if err == sql.ErrNoRows {
+        return Task{}, apperror.NotFound("Story no longer exists")
+    }
+    if err != nil {
+        return Task{}, apperror.Internal("Error getting story", err)
+    }
+    if !isStoryOrganizer {
+        return Task{}, apperror.Forbidden("Only story organizers can do this")
+    }
+    invalidWindow, err := validateTaskWindow(db, storyID, startTime, endTime)
+    if err != nil {
+        return Task{}, apperror.Internal("Error getting story", err)
+    }
+    if invalidWindow != "" {
+        return Task{}, apperror.Validation(invalidWindow)
+    }
+
+    result, err := db.Exec(`
+        INSERT INTO task (story_id, name, description, slots, exclusive_group, section, start_time, end_time, position)
+        SELECT $1, $2, $3, $4, $5, $6, $7, $8, ` + nextTaskPosition + `
+        FROM task
+        WHERE story_id = $1
+        `,
+        storyID, name, description, slots, exclusiveGroup, section, startTime, endTime,
+    )
+    if err != nil {
+        return Task{}, apperror.Internal("Error creating task", err)
+    }
+
+    id, err := result.LastInsertId()
+    if err != nil {
+        return Task{}, apperror.Internal("Error creating task", err)
+    }
+    row := db.QueryRow("SELECT position FROM task WHERE id = $1", id)
+    var position int64
+    err = row.Scan(&position)
+    if err != nil {
+        return Task{}, apperror.Internal("Error creating task", err)
+    }
+
+    task := Task{
+        ID: id,
+        StoryID: storyID,
+        Name: name,
+        Description: description,
+        SlotsTotal: slots,
+        SlotsAssigned: 0,
+        ExclusiveGroup: exclusiveGroup,
+        Section: section,
+        Position: position,
+        AssignmentList: []Assignments{},
+        HasJoined: false,
+        IsStoryOrganizer: true,
+        IsUserLoggedIn: true,
+    }
+    setTaskWindow(&task, startTime, endTime)
+    publishTaskEvent(db, webhook.TaskCreated, task)
+    return task, nil
+}
+
+func AddTaskToStoryFinalizeHandler (w http.ResponseWriter, r *http.Request) {
+    task, err := createTaskToStoryHandler(r)
+    if err != nil {
+        writeError(w, r, err)
+        return
+    }
+
+    renderTemplate(w, r, "task", "task-list-element-base", task)
+}
+
+func AddTaskToStoryHandler (w http.ResponseWriter, r *http.Request) {
+    task, err := createTaskToStoryHandler(r)
+    if err != nil {
+        writeError(w, r, err)
+        return
+    }
+
+    renderTemplate(w, r, "task-view", "task-list-element-view.html", task)
+}
+
+func ChangeStoryTaskAssignmentHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    action := r.PostFormValue("action")
+
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+    storyID, err := GetTaskStoryID(db, taskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    canView, err := CanViewStory(db, storyID, userID, "")
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+
+    locked, err := isTaskLocked(db, taskID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    if locked {
+        writeError(w, r, apperror.Forbidden("Task is locked by the organizers"))
+        return
+    }
+
+    logAction := AssignmentLeft
+    if action == "join" {
+        logAction = AssignmentJoined
+        err = joinTask(db, taskID, userID, true)
+        if _, ok := err.(*JoinRuleError); ok || err == ErrTaskFull || err == ErrAlreadyAssigned {
+            renderJoinConflict(w, r, db, taskID, userID, err)
+            return
+        }
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error changing task assignment", err))
+            return
+        }
+    } else {
+        result, err := db.Exec("DELETE FROM assignment WHERE task_id = $1 AND assignee_id = $2", taskID, userID)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error changing task assignment", err))
+            return
+        }
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error changing task assignment", err))
+            return
+        }
+        if rowsAffected != 1 {
+            writeError(w, r, apperror.Internal("Error changing task assignment", fmt.Errorf("incorrect number of rows changes")))
+            return
+        }
+    }
+    err = recordAssignmentChange(db, taskID, userID, userID, logAction)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error recording assignment change", err))
+        return
+    }
+    if logAction == AssignmentJoined {
+        publishAssignmentEvent(db, webhook.AssignmentJoined, taskID, userID, userID)
+    } else {
+        publishAssignmentEvent(db, webhook.AssignmentLeft, taskID, userID, userID)
+    }
+
+    notifyTaskChanged(db, taskID)
+    renderSingleTask(w, r, db, taskID, userID)
+}
+
+func ChangeStoryTaskViewHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+    taskID, userID, ok := organizedTaskFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    task, err := GetSingleTask(db, taskID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    task.IsUserLoggedIn = true
+
+    renderTemplate(w, r, "task", "task-detail-edit", task)
+}
+
+func TaskDetailHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    taskID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, sessionErr := auth.ValidateSession(db, r);
+    storyID, err := GetTaskStoryID(db, taskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    canView, err := CanViewStory(db, storyID, userID, r.URL.Query().Get("key"))
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if !canView {
+        writeError(w, r, apperror.Forbidden("You do not have access to this story"))
+        return
+    }
+    task, err := GetSingleTask(db, taskID, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    task.IsUserLoggedIn = sessionErr != nil
+
+    renderTemplate(w, r, "task", "task-detail-view", task)
+}
+
+func ChangeTaskHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    name := r.PostFormValue("name")
+    description := r.PostFormValue("description")
+    exclusiveGroup := strings.TrimSpace(r.PostFormValue("group"))
+    section := strings.TrimSpace(r.PostFormValue("section"))
+    slotsTotal, err := strconv.ParseInt(r.PostFormValue("slots"), 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", r.PostFormValue("slots"))))
+        return
+    }
+    if slotsTotal < 1 {
+        writeError(w, r, apperror.Validation("A task needs at least one slot"))
+        return
+    }
+    startTime, err := parseOptionalTime(r.PostFormValue("start"))
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse the start time: %s", err)))
+        return
+    }
+    endTime, err := parseOptionalTime(r.PostFormValue("end"))
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse the end time: %s", err)))
+        return
+    }
+    taskID, userID, ok := organizedTaskFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    storyID, err := GetTaskStoryID(db, taskID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    invalidWindow, err := validateTaskWindow(db, storyID, startTime, endTime)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return
+    }
+    if invalidWindow != "" {
+        writeError(w, r, apperror.Validation(invalidWindow))
+        return
+    }
+
+    // the update, the bumped assignments and their log entries go together,
+    // so a failure cannot leave a task with more assignees than slots
+    tx, err := db.Begin()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating task data", err))
+        return
+    }
+    defer tx.Rollback()
+
+    result, err := tx.Exec(
+        "UPDATE task SET name = $1, description = $2, slots = $3, exclusive_group = $4, section = $5, start_time = $6, end_time = $7 WHERE id = $8",
+        name, description, slotsTotal, exclusiveGroup, section, startTime, endTime, taskID,
+    )
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating task data", err))
+        return
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating task data", err))
+        return
+    }
+    if rowsAffected != 1 {
+        writeError(w, r, apperror.Internal("Error updating task", fmt.Errorf("incorrect numbers of rows affected: %d", rowsAffected)))
+        return
+    }
+
+    // the latest signups lose their slots when there are fewer slots now
+    bumpedAssignees := []int64{}
+    rows, err := tx.Query("SELECT assignee_id FROM assignment WHERE task_id = $1 ORDER BY id ASC LIMIT -1 OFFSET $2", taskID, slotsTotal)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating tasks slots", err))
+        return
+    }
+    for rows.Next() {
+        var assigneeID int64
+        err = rows.Scan(&assigneeID)
+        if err != nil {
+            rows.Close()
+            writeError(w, r, apperror.Internal("Error updating tasks slots", err))
+            return
+        }
+        bumpedAssignees = append(bumpedAssignees, assigneeID)
+    }
+    rows.Close()
+
+    if len(bumpedAssignees) > 0 {
+        result, err := tx.Exec(`
+            DELETE FROM assignment
+            WHERE task_id = $1
+            AND id NOT IN
+                (SELECT id FROM assignment WHERE task_id = $1 ORDER BY id ASC LIMIT $2)
+            `,
+            taskID,
+            slotsTotal,
+        )
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error updating tasks slots", err))
+            return
+        }
+
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error updating tasks slots", err))
+            return
+        }
+        if rowsAffected != int64(len(bumpedAssignees)) {
+            writeError(w, r, apperror.Internal("Error deleting assignments due to the slots change in task", fmt.Errorf("deleted %d instead of %d", rowsAffected, len(bumpedAssignees))))
+            return
+        }
+        for _, assigneeID := range bumpedAssignees {
+            err = recordAssignmentChange(tx, taskID, assigneeID, userID, AssignmentRemoved)
+            if err != nil {
+                writeError(w, r, apperror.Internal("Error recording assignment change", err))
+                return
+            }
+        }
+    }
+    err = tx.Commit()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error updating task data", err))
+        return
+    }
+
+    task, err := GetSingleTask(db, taskID, userID)
+    task.IsUserLoggedIn = true
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    publishTaskEvent(db, webhook.TaskUpdated, task)
+
+    if len(bumpedAssignees) > 0 {
+        for _, assigneeID := range bumpedAssignees {
+            publishAssignmentEvent(db, webhook.AssignmentLeft, taskID, assigneeID, userID)
+        }
+        _, storyTitle, _ := getTaskNames(db, taskID)
+        notifyUsers(db, NotificationAssignmentChanges, bumpedAssignees, userID, "slots-reduced", NotificationData{
+            StoryID: storyID,
+            ActorName: getUsername(db, userID),
+            StoryTitle: storyTitle,
+            TaskName: name,
+        })
+
+        notifyTaskChanged(db, taskID)
+        renderSingleTask(w, r, db, taskID, userID)
+        return
+    }
+
+    notifyTaskChanged(db, taskID)
+    renderTaskElement(w, r, task)
+}
+
+func DeleteStoryTaskHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+    id, userID, ok := organizedTaskFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    storyID, err := GetTaskStoryID(db, id)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Task no longer exists"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    taskName, storyTitle, err := getTaskNames(db, id)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+    assigneeIDs, err := GetTaskAssigneeIDs(db, id)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task assignees", err))
+        return
+    }
+    deletedTask, err := GetSingleTask(db, id, userID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting task data", err))
+        return
+    }
+
+    _, err = db.Exec("DELETE FROM assignment WHERE task_id = $1", id)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting task assignments", err))
+        return
+    }
+    _, err = db.Exec("DELETE FROM comment WHERE task_id = $1", id)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting task comments", err))
+        return
+    }
+    result, err := db.Exec("DELETE FROM task WHERE id = $1", id)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting task", err))
+        return
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting task", err))
+        return
+    }
+    if rowsAffected != 1 {
+        writeError(w, r, apperror.Internal("Error deleting story task", fmt.Errorf("incorrect numbers of rows affected: %d", rowsAffected)))
+        return
+    }
+    notifyTaskDeleted(storyID, id)
+    publishTaskEvent(db, webhook.TaskDeleted, deletedTask)
+    notifyUsers(db, NotificationTaskChanges, assigneeIDs, userID, "task-deleted", NotificationData{
+        StoryID: storyID,
+        ActorName: getUsername(db, userID),
+        StoryTitle: storyTitle,
+        TaskName: taskName,
+    })
+}
+
+func updateStoryHandler (r *http.Request) (Story, error) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        return Story{}, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"]))
+    }
+    db, err := OpenDB()
+    if err != nil {
+        return Story{}, apperror.Internal("Error connecting to database", err)
+
+    }
+    title := r.PostFormValue("title")
+    description := r.PostFormValue("description")
+    startTime, err := strconv.ParseInt(r.PostFormValue("time"), 10, 64)
+    if err != nil {
+        return Story{}, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", r.PostFormValue("time")))
+    }
+    visibility, err := ParseVisibility(r.PostFormValue("visibility"))
+    if err != nil {
+        return Story{}, apperror.Validation(fmt.Sprintf("Cannot parse value %s as visibility", r.PostFormValue("visibility")))
+    }
+    endTime, err := parseOptionalTime(r.PostFormValue("end_time"))
+    if err != nil {
+        return Story{}, apperror.Validation(fmt.Sprintf("Cannot parse the end time: %s", err))
+    }
+    if endTime.Valid && endTime.Int64 <= startTime {
+        return Story{}, apperror.Validation("Story has to end after it starts")
+    }
+    maxTasksPerUser := int64(0)
+    if r.PostFormValue("max_tasks") != "" {
+        maxTasksPerUser, err = strconv.ParseInt(r.PostFormValue("max_tasks"), 10, 64)
+        if err != nil || maxTasksPerUser < 0 {
+            return Story{}, apperror.Validation(fmt.Sprintf("Cannot parse value %s as task limit", r.PostFormValue("max_tasks")))
+        }
+    }
+    maxNoShows := int64(0)
+    if r.PostFormValue("max_no_shows") != "" {
+        maxNoShows, err = strconv.ParseInt(r.PostFormValue("max_no_shows"), 10, 64)
+        if err != nil || maxNoShows < 0 {
+            return Story{}, apperror.Validation(fmt.Sprintf("Cannot parse value %s as no-show limit", r.PostFormValue("max_no_shows")))
+        }
+    }
+    userID, _, sessionErr := auth.ValidateSession(db, r)
+    if sessionErr != nil {
+        return Story{}, apperror.Unauthorized("Cannot find valid session")
+    }
+    isStoryOrganizer, err := IsStoryOrganizer(db, storyID, userID)
+    if err == sql.ErrNoRows {
+        return Story{}, apperror.NotFound("Story no longer exists")
+    }
+    if err != nil {
+        return Story{}, apperror.Internal("Error getting story", err)
+    }
+    if !isStoryOrganizer {
+        return Story{}, apperror.Forbidden("Only story organizers can do this")
+    }
+    taskOutside, err := findTaskOutsideStory(db, storyID, startTime, endTime)
+    if err != nil {
+        return Story{}, apperror.Internal("Error getting story tasks", err)
+    }
+    if taskOutside != "" {
+        return Story{}, apperror.Validation(fmt.Sprintf("Task %s does not fit into the story time", taskOutside))
+    }
+    row := db.QueryRow("SELECT start_time, end_time, status FROM story WHERE id = $1", storyID)
+    var oldStartTime sql.NullInt64
+    var oldEndTime sql.NullInt64
+    var oldStatusOption sql.NullInt64
+    err = row.Scan(&oldStartTime, &oldEndTime, &oldStatusOption)
+    if err != nil {
+        return Story{}, apperror.Internal("Error getting story", err)
+    }
+
+    result, err := db.Exec(
+        "UPDATE story SET title = $1, description = $2, start_time = $3, end_time = $4, visibility = $5, max_tasks_per_user = $6, max_no_shows = $7, status = 1 WHERE id = $8",
+        title, description, startTime, endTime, visibility, maxTasksPerUser, maxNoShows, storyID,
+    )
+    if err != nil {
+        return Story{}, apperror.Internal("Error updating story", err)
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return Story{}, apperror.Internal("Error updating story", err)
+    }
+    if rowsAffected != 1 {
+        return Story{}, apperror.Internal("Error updating story", fmt.Errorf("incorrect numbers of rows affected: %d", rowsAffected))
+    }
+    story, err := GetStoryData(db, storyID, userID)
+    if err != nil {
+        return Story{}, apperror.Internal("Error updating story", err)
+    }
+
+    newStartTime := sql.NullInt64{ Int64: startTime, Valid: true }
+    if oldStartTime.Valid && (oldStartTime != newStartTime || oldEndTime != endTime) {
+        assigneeIDs, err := GetStoryAssigneeIDs(db, storyID)
+        if err != nil {
+            return Story{}, apperror.Internal("Error getting story assignees", err)
+        }
+        notifyUsers(db, NotificationStoryChanges, assigneeIDs, userID, "story-changed", NotificationData{
+            StoryID: storyID,
+            ActorName: getUsername(db, userID),
+            StoryTitle: title,
+            StartTime: formatOptionalTime(newStartTime, DisplayTimeFormat),
+            EndTime: formatOptionalTime(endTime, DisplayTimeFormat),
+        })
+    }
+    if oldStatusOption.Int64 == 0 {
+        publishStoryEvent(db, webhook.StoryPublished, storyID)
+    } else {
+        publishStoryEvent(db, webhook.StoryUpdated, storyID)
+    }
+
+    return story, nil
+}
+
+type StoryViewPageData struct {
+    Story Story
+}
+
+func ChangeStoryHandler (w http.ResponseWriter, r *http.Request) {
+    story, err := updateStoryHandler(r)
+    if err != nil {
+        writeError(w, r, err)
+        return
+    }
+
+    renderTemplate(w, r, "story-view", "story-detail-view", StoryViewPageData { Story: story })
+}
+
+func FinalizeCreateStoryHandler (w http.ResponseWriter, r *http.Request) {
+    _, err := updateStoryHandler(r)
+    if err != nil {
+        writeError(w, r, err)
+        return
+    }
+
+    w.Header().Add("HX-Trigger", "reload-stories")
+}
+
+// storyDependents deletes what belongs to a story, children before their parents.
+var storyDependents = []string{
+    "DELETE FROM attendance_record WHERE story_id = $1",
+    "DELETE FROM assignment_log WHERE task_id IN (SELECT id FROM task WHERE story_id = $1)",
+    "DELETE FROM assignment WHERE task_id IN (SELECT id FROM task WHERE story_id = $1)",
+    "DELETE FROM comment WHERE story_id = $1",
+    "DELETE FROM task WHERE story_id = $1",
+    "DELETE FROM story_organizer WHERE story_id = $1",
+    "DELETE FROM story_invitee WHERE story_id = $1",
+    "DELETE FROM story_invite_link WHERE story_id = $1",
+    "DELETE FROM story_reminder WHERE story_id = $1",
+    "UPDATE notification SET story_id = NULL WHERE story_id = $1",
+}
+
+// DeleteStory removes the story with everything that belongs to it in one
+// transaction and tells its webhooks once the story is gone. Notifications
+// about the story stay in the inboxes without the link.
+func DeleteStory(db *sql.DB, storyID int64) error {
+    webhookData, err := getStoryWebhookData(db, storyID)
+    if err != nil {
+        return err
+    }
+    targets, err := getWebhookTargets(db, storyID)
+    if err != nil {
+        return err
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for _, query := range storyDependents {
+        _, err = tx.Exec(query, storyID)
+        if err != nil {
+            return err
+        }
+    }
+    err = deleteStoryWebhooks(tx, storyID)
+    if err != nil {
+        return err
+    }
+    result, err := tx.Exec("DELETE FROM story WHERE id = $1", storyID)
+    if err != nil {
+        return err
+    }
+
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rowsAffected != 1 {
+        return fmt.Errorf("incorrect number of rows affected: %d", rowsAffected)
+    }
+    err = tx.Commit()
+    if err != nil {
+        return err
+    }
+    dispatchWebhookEvent(targets, webhook.StoryCancelled, storyID, webhookData)
+    return nil
+}
+
+func DeleteStoryHandler(w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    id, _, ok := storyFromRequest(w, r, db, true)
+    if !ok {
+        return
+    }
+    err = DeleteStory(db, id)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting story", err))
+        return
+    }
+    w.Header().Add("HX-Redirect", "/")
 }
\ No newline at end of file
@@ -0,0 +1,104 @@
+package server
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestStoryListShowsManagedStoriesToCoOrganizers(t *testing.T) {
+    db := openTestDB(t)
+    err := LoadTemplates()
+    if err != nil {
+        t.Fatal(err)
+    }
+    ownerID := createTestUser(t, db, "owner")
+    organizerID := createTestUser(t, db, "organizer")
+    strangerID := createTestUser(t, db, "stranger")
+    for title, visibility := range map[string]int64{ "Unlisted story": VisibilityUnlisted, "Invite-only story": VisibilityInviteOnly } {
+        storyID := mustExec(t, db, "INSERT INTO story (title, creator_id, status, visibility) VALUES($1, $2, 1, $3)", title, ownerID, visibility)
+        mustExec(t, db, "INSERT INTO story_organizer (story_id, user_id) VALUES($1, $2)", storyID, organizerID)
+    }
+
+    for userID, listed := range map[int64]bool{ ownerID: true, organizerID: true, strangerID: false } {
+        recorder := serveTestRequest(t, db, StoryListHandler, "GET", "/story", nil, userID)
+        if recorder.Code != http.StatusOK {
+            t.Fatalf("user %d: got status %d", userID, recorder.Code)
+        }
+        for _, title := range []string{ "Unlisted story", "Invite-only story" } {
+            if strings.Contains(recorder.Body.String(), title) != listed {
+                t.Errorf("user %d: %s listed is %v, want %v", userID, title, !listed, listed)
+            }
+        }
+    }
+}
+
+func TestDeleteStoryRemovesItsRows(t *testing.T) {
+    db := openTestDB(t)
+    ownerID := createTestUser(t, db, "owner")
+    userID := createTestUser(t, db, "user")
+    start := time.Now().Add(24 * time.Hour).Unix()
+    storyIDs := []int64{}
+    taskIDs := []int64{}
+    for _, title := range []string{ "Deleted", "Kept" } {
+        storyID := mustExec(t, db, "INSERT INTO story (title, creator_id, status) VALUES($1, $2, 1)", title, ownerID)
+        storyIDs = append(storyIDs, storyID)
+        taskIDs = append(taskIDs, mustExec(t, db, "INSERT INTO task (story_id, name, slots, start_time, end_time) VALUES($1, 'Task', 2, $2, $3)", storyID, start, start + 3600))
+    }
+    err := joinTask(db, taskIDs[0], userID, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    mustExec(t, db, "INSERT INTO comment (story_id, task_id, author_id, body, created_at) VALUES($1, $2, $3, 'Hi', 0)", storyIDs[0], taskIDs[0], userID)
+    mustExec(t, db, "INSERT INTO story_organizer (story_id, user_id) VALUES($1, $2)", storyIDs[0], userID)
+    mustExec(t, db, "INSERT INTO attendance_record (task_id, user_id, story_id, attendance, recorded_at) VALUES($1, $2, $3, 1, 0)", taskIDs[0], userID, storyIDs[0])
+
+    err = DeleteStory(db, storyIDs[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, table := range []string{ "task", "assignment", "assignment_log", "comment", "story_organizer", "attendance_record" } {
+        var count int
+        err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+        if err != nil {
+            t.Fatal(err)
+        }
+        want := 0
+        if table == "task" {
+            want = 1
+        }
+        if count != want {
+            t.Errorf("%s has %d rows left, want %d", table, count, want)
+        }
+    }
+
+    // the assignment of the deleted story no longer blocks the same time slot
+    err = joinTask(db, taskIDs[1], userID, true)
+    if err != nil {
+        t.Errorf("joining a task at the time of a deleted one: %v", err)
+    }
+}
+
+func TestMissingStoryOrTaskIsNotFound(t *testing.T) {
+    db := openTestDB(t)
+    userID := createTestUser(t, db, "user")
+
+    for name, handler := range map[string]http.HandlerFunc{
+        "story": StoryDetailHandler,
+        "story calendar": StoryCalendarHandler,
+        "story check-in": StoryCheckInHandler,
+        "story webhooks": StoryWebhooksHandler,
+        "task": TaskDetailHandler,
+        "task calendar": TaskCalendarHandler,
+        "task lock": ChangeTaskLockHandler,
+    } {
+        for _, loggedIn := range []int64{ 0, userID } {
+            recorder := serveTestRequest(t, db, handler, "GET", "/", map[string]string{ "id": "999" }, loggedIn)
+            if recorder.Code == http.StatusNotFound || (loggedIn == 0 && recorder.Code == http.StatusUnauthorized) {
+                continue
+            }
+            t.Errorf("%s, user %d: got status %d, want 404", name, loggedIn, recorder.Code)
+        }
+    }
+}
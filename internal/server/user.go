@@ -0,0 +1,87 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+    "zmtwc/sk/internal/auth"
+)
+
+type StorySummary struct {
+    ID int64
+    Title string
+    Status int64
+    StartTime string
+    CreatorName string
+    TaskCount int64
+}
+
+// CreateUser creates the user in one statement, so a failure leaves no
+// account behind. It returns auth.ErrUsernameTaken for a taken username.
+func CreateUser(db *sql.DB, username string, password string, email string) (int64, error) {
+    return auth.SavePasswordForUser(db, username, password, email)
+}
+
+func updateUser(db *sql.DB, query string, value bool, userID int64) error {
+    result, err := db.Exec(query, value, userID)
+    if err != nil {
+        return err
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rowsAffected != 1 {
+        return fmt.Errorf("Cannot find user %d", userID)
+    }
+    return nil
+}
+
+// SetUserDisabled blocks or allows logging in, a disabled user is logged out right away.
+func SetUserDisabled(db *sql.DB, userID int64, disabled bool) error {
+    err := updateUser(db, "UPDATE user SET disabled = $1 WHERE id = $2", disabled, userID)
+    if err != nil || !disabled {
+        return err
+    }
+    return auth.DeleteSessions(db, userID)
+}
+
+func SetUserAdmin(db *sql.DB, userID int64, admin bool) error {
+    return updateUser(db, "UPDATE user SET is_admin = $1 WHERE id = $2", admin, userID)
+}
+
+// ListStories returns every story including drafts, newest first.
+func ListStories(db *sql.DB) ([]StorySummary, error) {
+    rows, err := db.Query(`
+        SELECT story.id, story.title, story.status, story.start_time, user.username, COUNT(task.id)
+        FROM story
+        JOIN user ON user.id = story.creator_id
+        LEFT JOIN task ON task.story_id = story.id
+        GROUP BY story.id
+        ORDER BY story.id DESC
+        `,
+    )
+    if err != nil {
+        return []StorySummary{}, err
+    }
+    defer rows.Close()
+
+    stories := []StorySummary{}
+    for rows.Next() {
+        var story StorySummary
+        var titleOption sql.NullString
+        var statusOption sql.NullInt64
+        var startOption sql.NullInt64
+        err = rows.Scan(&story.ID, &titleOption, &statusOption, &startOption, &story.CreatorName, &story.TaskCount)
+        if err != nil {
+            return []StorySummary{}, err
+        }
+        story.Title = titleOption.String
+        story.Status = statusOption.Int64
+        if startOption.Valid {
+            story.StartTime = time.Unix(startOption.Int64, 0).Format(DisplayTimeFormat)
+        }
+        stories = append(stories, story)
+    }
+    return stories, nil
+}
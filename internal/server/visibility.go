@@ -0,0 +1,370 @@
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+)
+
+const (
+    VisibilityPublic int64 = 0
+    VisibilityUnlisted int64 = 1
+    VisibilityInviteOnly int64 = 2
+)
+
+type InviteLink struct {
+    ID int64
+    Token string
+}
+
+type Invitee struct {
+    UserID int64
+    Username string
+}
+
+type StorySharingData struct {
+    StoryID int64
+    Visibility int64
+    Links []InviteLink
+    Invitees []Invitee
+}
+
+func ParseVisibility(value string) (int64, error) {
+    if value == "" {
+        return VisibilityPublic, nil
+    }
+    visibility, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+        return 0, err
+    }
+    if visibility < VisibilityPublic || visibility > VisibilityInviteOnly {
+        return 0, fmt.Errorf("Unknown visibility %d", visibility)
+    }
+    return visibility, nil
+}
+
+func GetInviteLinkStoryID(db *sql.DB, token string) (int64, error) {
+    row := db.QueryRow("SELECT story_id FROM story_invite_link WHERE token = $1 AND revoked = 0", token)
+    var storyID int64
+    err := row.Scan(&storyID)
+    return storyID, err
+}
+
+func GetTaskStoryID(db *sql.DB, taskID int64) (int64, error) {
+    row := db.QueryRow("SELECT story_id FROM task WHERE id = $1", taskID)
+    var storyID int64
+    err := row.Scan(&storyID)
+    return storyID, err
+}
+
+// CanViewStory checks whether the user (0 when logged out) can see the story.
+// Public stories are open to everyone and organizers and invited users see
+// their stories. Unlisted stories also open with a valid invite link token,
+// invite-only stories need a logged in user who was invited or redeemed a link.
+func CanViewStory(db *sql.DB, storyID int64, userID int64, inviteToken string) (bool, error) {
+    row := db.QueryRow(`
+        SELECT
+            story.visibility,
+            story.creator_id = $2
+            OR EXISTS (SELECT 1 FROM story_organizer WHERE story_organizer.story_id = story.id AND story_organizer.user_id = $2)
+            OR EXISTS (SELECT 1 FROM story_invitee WHERE story_invitee.story_id = story.id AND story_invitee.user_id = $2)
+        FROM story
+        WHERE story.id = $1
+        `,
+        storyID,
+        userID,
+    )
+    var visibilityOption sql.NullInt64
+    var isMember bool
+    err := row.Scan(&visibilityOption, &isMember)
+    if err != nil {
+        return false, err
+    }
+    if !visibilityOption.Valid || visibilityOption.Int64 == VisibilityPublic {
+        return true, nil
+    }
+    if userID != 0 && isMember {
+        return true, nil
+    }
+    if visibilityOption.Int64 != VisibilityUnlisted || inviteToken == "" {
+        return false, nil
+    }
+    linkStoryID, err := GetInviteLinkStoryID(db, inviteToken)
+    if err == sql.ErrNoRows {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return linkStoryID == storyID, nil
+}
+
+func RedeemInviteLink(db *sql.DB, token string, userID int64) (int64, error) {
+    storyID, err := GetInviteLinkStoryID(db, token)
+    if err != nil {
+        return 0, err
+    }
+    _, err = db.Exec("INSERT OR IGNORE INTO story_invitee (story_id, user_id) VALUES($1, $2)", storyID, userID)
+    if err != nil {
+        return 0, err
+    }
+    return storyID, nil
+}
+
+func GetStorySharing(db *sql.DB, storyID int64) (StorySharingData, error) {
+    row := db.QueryRow("SELECT visibility FROM story WHERE id = $1", storyID)
+    var visibilityOption sql.NullInt64
+    err := row.Scan(&visibilityOption)
+    if err != nil {
+        return StorySharingData{}, err
+    }
+
+    links := []InviteLink{}
+    rows, err := db.Query("SELECT id, token FROM story_invite_link WHERE story_id = $1 AND revoked = 0", storyID)
+    if err != nil {
+        return StorySharingData{}, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var link InviteLink
+        err = rows.Scan(&link.ID, &link.Token)
+        if err != nil {
+            return StorySharingData{}, err
+        }
+        links = append(links, link)
+    }
+
+    invitees := []Invitee{}
+    inviteeRows, err := db.Query(`
+        SELECT
+            user.id,
+            user.username
+        FROM story_invitee
+        JOIN user ON user.id = story_invitee.user_id
+        WHERE story_invitee.story_id = $1
+        `,
+        storyID,
+    )
+    if err != nil {
+        return StorySharingData{}, err
+    }
+    defer inviteeRows.Close()
+    for inviteeRows.Next() {
+        var invitee Invitee
+        err = inviteeRows.Scan(&invitee.UserID, &invitee.Username)
+        if err != nil {
+            return StorySharingData{}, err
+        }
+        invitees = append(invitees, invitee)
+    }
+
+    return StorySharingData{
+        StoryID: storyID,
+        Visibility: visibilityOption.Int64,
+        Links: links,
+        Invitees: invitees,
+    }, nil
+}
+
+func renderStorySharing(w http.ResponseWriter, r *http.Request, db *sql.DB, storyID int64) {
+    sharing, err := GetStorySharing(db, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story sharing", err))
+        return
+    }
+
+    renderTemplate(w, r, "story-sharing", "story-sharing", sharing)
+}
+
+func StorySharingHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    renderStorySharing(w, r, db, storyID)
+}
+
+func CreateInviteLinkHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    _, err = db.Exec("INSERT INTO story_invite_link (story_id, token) VALUES($1, $2)", storyID, uuid.New().String())
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating invite link", err))
+        return
+    }
+    renderStorySharing(w, r, db, storyID)
+}
+
+func RevokeInviteLinkHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    linkID, err := strconv.ParseInt(vars["linkID"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["linkID"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    result, err := db.Exec("UPDATE story_invite_link SET revoked = 1 WHERE id = $1 AND story_id = $2", linkID, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error revoking invite link", err))
+        return
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error revoking invite link", err))
+        return
+    }
+    // a link that is revoked already still matches, so revoking twice is not an error
+    if rowsAffected == 0 {
+        writeError(w, r, apperror.NotFound("This invite link does not exist"))
+        return
+    }
+    renderStorySharing(w, r, db, storyID)
+}
+
+func AddStoryInviteeHandler (w http.ResponseWriter, r *http.Request) {
+    username := r.PostFormValue("username")
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    row := db.QueryRow("SELECT id FROM user WHERE username = $1", username)
+    var inviteeID int64
+    err = row.Scan(&inviteeID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot find user %s", username)))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting user", err))
+        return
+    }
+
+    _, err = db.Exec("INSERT OR IGNORE INTO story_invitee (story_id, user_id) VALUES($1, $2)", storyID, inviteeID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error inviting user", err))
+        return
+    }
+    renderStorySharing(w, r, db, storyID)
+}
+
+func RemoveStoryInviteeHandler (w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    inviteeID, err := strconv.ParseInt(vars["userID"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["userID"])))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, ok := organizedStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    _, err = db.Exec("DELETE FROM story_invitee WHERE story_id = $1 AND user_id = $2", storyID, inviteeID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error removing invited user", err))
+        return
+    }
+    renderStorySharing(w, r, db, storyID)
+}
+
+func InviteLinkHandler (w http.ResponseWriter, r *http.Request) {
+    token := mux.Vars(r)["token"]
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, err := GetInviteLinkStoryID(db, token)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Invite link is not valid"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting invite link", err))
+        return
+    }
+
+    userID, _, sessionErr := auth.ValidateSession(db, r);
+    if sessionErr == nil {
+        _, err = RedeemInviteLink(db, token, userID)
+        if err != nil {
+            writeError(w, r, apperror.Internal("Error accepting invite", err))
+            return
+        }
+    }
+
+    renderLandingPage(w, r, LandingPageData {
+        InitialContent: fmt.Sprintf("/story/%d?key=%s", storyID, token),
+    })
+}
+
+func RedeemInviteCodeHandler (w http.ResponseWriter, r *http.Request) {
+    code := r.PostFormValue("code")
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return
+    }
+
+    _, err = RedeemInviteLink(db, code, userID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Invite code is not valid"))
+        return
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error accepting invite", err))
+        return
+    }
+    w.Header().Add("HX-Redirect", "/invite/"+code)
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "testing"
+)
+
+func TestRevokeInviteLinkTwice(t *testing.T) {
+    db := openTestDB(t)
+    err := LoadTemplates()
+    if err != nil {
+        t.Fatal(err)
+    }
+    organizerID := createTestUser(t, db, "organizer")
+    storyID := mustExec(t, db, "INSERT INTO story (title, creator_id, status, visibility) VALUES('Story', $1, 1, $2)", organizerID, VisibilityUnlisted)
+    linkID := mustExec(t, db, "INSERT INTO story_invite_link (story_id, token) VALUES($1, 'token')", storyID)
+
+    vars := map[string]string{ "id": fmt.Sprint(storyID), "linkID": fmt.Sprint(linkID) }
+    for i := 0; i < 2; i++ {
+        recorder := serveTestRequest(t, db, RevokeInviteLinkHandler, "DELETE", "/", vars, organizerID)
+        if recorder.Code != http.StatusOK {
+            t.Errorf("revoke %d: got status %d, want 200", i + 1, recorder.Code)
+        }
+    }
+
+    vars["linkID"] = fmt.Sprint(linkID + 1)
+    recorder := serveTestRequest(t, db, RevokeInviteLinkHandler, "DELETE", "/", vars, organizerID)
+    if recorder.Code != http.StatusNotFound {
+        t.Errorf("revoking an unknown link: got status %d, want 404", recorder.Code)
+    }
+}
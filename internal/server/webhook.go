@@ -0,0 +1,437 @@
+package server
+
+import (
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+    "zmtwc/sk/internal/apperror"
+    "zmtwc/sk/internal/auth"
+    "zmtwc/sk/internal/webhook"
+
+    "github.com/gorilla/mux"
+)
+
+var webhooks = webhook.NewDispatcher(recordWebhookAttempt)
+
+type Webhook struct {
+    ID int64
+    URL string
+    Secret string
+    Deliveries []WebhookDelivery
+}
+
+type WebhookDelivery struct {
+    Event string
+    Attempt int64
+    StatusCode int64
+    Error string
+    CreatedAt string
+    Succeeded bool
+}
+
+type StoryWebhooksData struct {
+    StoryID int64
+    Webhooks []Webhook
+    Notice string
+}
+
+type StoryWebhookData struct {
+    ID int64 `json:"id"`
+    Title string `json:"title"`
+    Description string `json:"description"`
+    StartTime int64 `json:"start_time"`
+    EndTime int64 `json:"end_time,omitempty"`
+}
+
+type AssignmentWebhookData struct {
+    Task TaskJSON `json:"task"`
+    UserID int64 `json:"user_id"`
+    Username string `json:"username"`
+    ActorName string `json:"actor"`
+}
+
+func recordWebhookAttempt(attempt webhook.Attempt) {
+    db, err := OpenDB()
+    if err != nil {
+        slog.Error("Error connecting to database", "error", err)
+        return
+    }
+
+    errorOption := sql.NullString{}
+    if attempt.Err != nil {
+        errorOption = sql.NullString{ String: attempt.Err.Error(), Valid: true }
+    }
+    // the webhook may have been deleted together with its story while the attempt was running
+    _, err = db.Exec(`
+        INSERT INTO webhook_delivery (webhook_id, delivery_id, event, attempt, status_code, error, payload, created_at)
+        SELECT $1, $2, $3, $4, $5, $6, $7, $8
+        WHERE EXISTS (SELECT 1 FROM webhook WHERE id = $1)
+        `,
+        attempt.WebhookID, attempt.DeliveryID, attempt.Event, attempt.Number, attempt.StatusCode, errorOption, string(attempt.Body), attempt.Time.Unix(),
+    )
+    if err != nil {
+        slog.Error("Error recording webhook delivery", "error", err)
+    }
+}
+
+func getWebhookTargets(db *sql.DB, storyID int64) ([]webhook.Target, error) {
+    rows, err := db.Query("SELECT id, url, secret FROM webhook WHERE story_id = $1", storyID)
+    if err != nil {
+        return []webhook.Target{}, err
+    }
+    defer rows.Close()
+
+    targets := []webhook.Target{}
+    for rows.Next() {
+        var target webhook.Target
+        err = rows.Scan(&target.WebhookID, &target.URL, &target.Secret)
+        if err != nil {
+            return []webhook.Target{}, err
+        }
+        targets = append(targets, target)
+    }
+    return targets, nil
+}
+
+// publishWebhookEvent sends the event to every webhook of the story. Delivery
+// happens in the background, failures only show up in the delivery log.
+func publishWebhookEvent(db *sql.DB, event string, storyID int64, data any) {
+    targets, err := getWebhookTargets(db, storyID)
+    if err != nil {
+        slog.Error("Error getting webhooks", "story_id", storyID, "error", err)
+        return
+    }
+    dispatchWebhookEvent(targets, event, storyID, data)
+}
+
+// dispatchWebhookEvent sends the event to targets read beforehand, for events
+// about a story whose webhooks are gone by the time the event is sent.
+func dispatchWebhookEvent(targets []webhook.Target, event string, storyID int64, data any) {
+    for _, target := range targets {
+        err := webhooks.Dispatch(target, webhook.NewPayload(event, storyID, data))
+        if err != nil {
+            slog.Error("Error dispatching webhook", "webhook_id", target.WebhookID, "error", err)
+        }
+    }
+}
+
+func getStoryWebhookData(db *sql.DB, storyID int64) (StoryWebhookData, error) {
+    row := db.QueryRow("SELECT title, description, start_time, end_time FROM story WHERE id = $1", storyID)
+    var titleOption sql.NullString
+    var descriptionOption sql.NullString
+    var startOption sql.NullInt64
+    var endOption sql.NullInt64
+    err := row.Scan(&titleOption, &descriptionOption, &startOption, &endOption)
+    if err != nil {
+        return StoryWebhookData{}, err
+    }
+    return StoryWebhookData{
+        ID: storyID,
+        Title: titleOption.String,
+        Description: descriptionOption.String,
+        StartTime: startOption.Int64,
+        EndTime: endOption.Int64,
+    }, nil
+}
+
+func publishStoryEvent(db *sql.DB, event string, storyID int64) {
+    data, err := getStoryWebhookData(db, storyID)
+    if err != nil {
+        slog.Error("Error getting story for webhooks", "story_id", storyID, "error", err)
+        return
+    }
+    publishWebhookEvent(db, event, storyID, data)
+}
+
+func publishTaskEvent(db *sql.DB, event string, task Task) {
+    publishWebhookEvent(db, event, task.StoryID, newTaskJSON(task))
+}
+
+func publishAssignmentEvent(db *sql.DB, event string, taskID int64, assigneeID int64, actorID int64) {
+    task, err := GetSingleTask(db, taskID, 0)
+    if err != nil {
+        slog.Error("Error getting task for webhooks", "task_id", taskID, "error", err)
+        return
+    }
+    publishWebhookEvent(db, event, task.StoryID, AssignmentWebhookData{
+        Task: newTaskJSON(task),
+        UserID: assigneeID,
+        Username: getUsername(db, assigneeID),
+        ActorName: getUsername(db, actorID),
+    })
+}
+
+// CanManageWebhooks checks whether the user organizes the story or is an admin.
+func CanManageWebhooks(db *sql.DB, storyID int64, userID int64) (bool, error) {
+    isOrganizer, err := IsStoryOrganizer(db, storyID, userID)
+    if err != nil || isOrganizer {
+        return isOrganizer, err
+    }
+    return IsAdmin(db, userID)
+}
+
+func webhookStoryFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB) (int64, int64, bool) {
+    vars := mux.Vars(r)
+    storyID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return 0, 0, false
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return 0, 0, false
+    }
+    canManage, err := CanManageWebhooks(db, storyID, userID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return 0, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return 0, 0, false
+    }
+    if !canManage {
+        writeError(w, r, apperror.Forbidden("Only story organizers can do this"))
+        return 0, 0, false
+    }
+    return storyID, userID, true
+}
+
+// webhookFromRequest resolves the webhook in the route and checks that the
+// session user can manage the webhooks of its story.
+func webhookFromRequest (w http.ResponseWriter, r *http.Request, db *sql.DB) (webhook.Target, int64, bool) {
+    vars := mux.Vars(r)
+    webhookID, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("Cannot parse value %s as integer", vars["id"])))
+        return webhook.Target{}, 0, false
+    }
+    userID, _, err := auth.ValidateSession(db, r);
+    if err != nil {
+        writeError(w, r, apperror.Unauthorized("Cannot find valid session"))
+        return webhook.Target{}, 0, false
+    }
+    row := db.QueryRow("SELECT id, url, secret, story_id FROM webhook WHERE id = $1", webhookID)
+    var target webhook.Target
+    var storyID int64
+    err = row.Scan(&target.WebhookID, &target.URL, &target.Secret, &storyID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Webhook no longer exists"))
+        return webhook.Target{}, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting webhook", err))
+        return webhook.Target{}, 0, false
+    }
+    canManage, err := CanManageWebhooks(db, storyID, userID)
+    if err == sql.ErrNoRows {
+        writeError(w, r, apperror.NotFound("Story no longer exists"))
+        return webhook.Target{}, 0, false
+    }
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting story", err))
+        return webhook.Target{}, 0, false
+    }
+    if !canManage {
+        writeError(w, r, apperror.Forbidden("Only story organizers can do this"))
+        return webhook.Target{}, 0, false
+    }
+    return target, storyID, true
+}
+
+func getWebhookDeliveries(db *sql.DB, webhookID int64) ([]WebhookDelivery, error) {
+    rows, err := db.Query(`
+        SELECT event, attempt, status_code, error, created_at
+        FROM webhook_delivery
+        WHERE webhook_id = $1
+        ORDER BY id DESC
+        LIMIT 10
+        `,
+        webhookID,
+    )
+    if err != nil {
+        return []WebhookDelivery{}, err
+    }
+    defer rows.Close()
+
+    deliveries := []WebhookDelivery{}
+    for rows.Next() {
+        var delivery WebhookDelivery
+        var statusCodeOption sql.NullInt64
+        var errorOption sql.NullString
+        var createdAt int64
+        err = rows.Scan(&delivery.Event, &delivery.Attempt, &statusCodeOption, &errorOption, &createdAt)
+        if err != nil {
+            return []WebhookDelivery{}, err
+        }
+        delivery.StatusCode = statusCodeOption.Int64
+        delivery.Error = errorOption.String
+        delivery.Succeeded = !errorOption.Valid
+        delivery.CreatedAt = time.Unix(createdAt, 0).Format(DisplayTimeFormat)
+        deliveries = append(deliveries, delivery)
+    }
+    return deliveries, nil
+}
+
+func GetStoryWebhooks(db *sql.DB, storyID int64) ([]Webhook, error) {
+    rows, err := db.Query("SELECT id, url, secret FROM webhook WHERE story_id = $1 ORDER BY id", storyID)
+    if err != nil {
+        return []Webhook{}, err
+    }
+    defer rows.Close()
+
+    storyWebhooks := []Webhook{}
+    for rows.Next() {
+        var storyWebhook Webhook
+        err = rows.Scan(&storyWebhook.ID, &storyWebhook.URL, &storyWebhook.Secret)
+        if err != nil {
+            return []Webhook{}, err
+        }
+        storyWebhooks = append(storyWebhooks, storyWebhook)
+    }
+    rows.Close()
+
+    for i := range storyWebhooks {
+        storyWebhooks[i].Deliveries, err = getWebhookDeliveries(db, storyWebhooks[i].ID)
+        if err != nil {
+            return []Webhook{}, err
+        }
+    }
+    return storyWebhooks, nil
+}
+
+func renderStoryWebhooks(w http.ResponseWriter, r *http.Request, db *sql.DB, storyID int64, notice string) {
+    storyWebhooks, err := GetStoryWebhooks(db, storyID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error getting webhooks", err))
+        return
+    }
+
+    renderTemplate(w, r, "story-webhooks", "story-webhooks", StoryWebhooksData{
+        StoryID: storyID,
+        Webhooks: storyWebhooks,
+        Notice: notice,
+    })
+}
+
+func StoryWebhooksHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, _, ok := webhookStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+    renderStoryWebhooks(w, r, db, storyID, "")
+}
+
+func CreateWebhookHandler (w http.ResponseWriter, r *http.Request) {
+    webhookURL, err := url.Parse(r.PostFormValue("url"))
+    if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("%s is not a valid http or https address", r.PostFormValue("url"))))
+        return
+    }
+    err = webhook.CheckURL(webhookURL)
+    if err != nil {
+        writeError(w, r, apperror.Validation(fmt.Sprintf("%s is not a public address, webhooks cannot reach internal services", webhookURL.Hostname())))
+        return
+    }
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    storyID, userID, ok := webhookStoryFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    secret := make([]byte, 32)
+    _, err = rand.Read(secret)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating webhook secret", err))
+        return
+    }
+    _, err = db.Exec(
+        "INSERT INTO webhook (story_id, url, secret, creator_id, created_at) VALUES($1, $2, $3, $4, $5)",
+        storyID, webhookURL.String(), hex.EncodeToString(secret), userID, time.Now().Unix(),
+    )
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error creating webhook", err))
+        return
+    }
+    renderStoryWebhooks(w, r, db, storyID, "")
+}
+
+func DeleteWebhookHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    target, storyID, ok := webhookFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    _, err = db.Exec("DELETE FROM webhook_delivery WHERE webhook_id = $1", target.WebhookID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting webhook deliveries", err))
+        return
+    }
+    _, err = db.Exec("DELETE FROM webhook WHERE id = $1", target.WebhookID)
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error deleting webhook", err))
+        return
+    }
+    renderStoryWebhooks(w, r, db, storyID, "")
+}
+
+func TestWebhookHandler (w http.ResponseWriter, r *http.Request) {
+    db, err := OpenDB()
+    if err != nil {
+        writeError(w, r, apperror.Internal("Error connecting to database", err))
+        return
+    }
+
+    target, storyID, ok := webhookFromRequest(w, r, db)
+    if !ok {
+        return
+    }
+
+    attempt := webhooks.Send(target, webhook.NewPayload(webhook.Ping, storyID, map[string]string{
+        "message": "This is a test delivery",
+    }))
+    notice := fmt.Sprintf("Test delivery to %s succeeded", target.URL)
+    if !attempt.Succeeded() {
+        notice = fmt.Sprintf("Test delivery to %s failed: %s", target.URL, attempt.Err)
+    }
+    renderStoryWebhooks(w, r, db, storyID, notice)
+}
+
+// deleteStoryWebhooks removes the webhooks of a deleted story together with their delivery log.
+func deleteStoryWebhooks(db execer, storyID int64) error {
+    _, err := db.Exec("DELETE FROM webhook_delivery WHERE webhook_id IN (SELECT id FROM webhook WHERE story_id = $1)", storyID)
+    if err != nil {
+        return err
+    }
+    _, err = db.Exec("DELETE FROM webhook WHERE story_id = $1", storyID)
+    return err
+}
+
+// StopWebhooks cancels pending retries and waits for deliveries in flight.
+func StopWebhooks() {
+    webhooks.Close()
+}
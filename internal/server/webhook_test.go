@@ -0,0 +1,68 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+    "zmtwc/sk/internal/webhook"
+)
+
+func TestWebhookDeliveryLog(t *testing.T) {
+    db := openTestDB(t)
+    var mu sync.Mutex
+    requests := 0
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        requests++
+        if requests == 1 {
+            w.WriteHeader(503)
+        }
+    }))
+    defer receiver.Close()
+
+    // the receiver listens on loopback, which the default client refuses
+    previous := webhooks
+    webhooks = webhook.NewDispatcher(recordWebhookAttempt)
+    webhooks.Client = &http.Client{ Timeout: time.Second }
+    webhooks.Backoff = 10 * time.Millisecond
+    t.Cleanup(func() {
+        webhooks = previous
+    })
+
+    organizerID := createTestUser(t, db, "organizer")
+    storyID := mustExec(t, db, "INSERT INTO story (title, creator_id, status, start_time) VALUES('Story', $1, 1, $2)", organizerID, time.Now().Unix())
+    webhookID := mustExec(t, db, "INSERT INTO webhook (story_id, url, secret, creator_id, created_at) VALUES($1, $2, 'secret', $3, $4)", storyID, receiver.URL, organizerID, time.Now().Unix())
+
+    publishStoryEvent(db, webhook.StoryUpdated, storyID)
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        var deliveries int
+        err := db.QueryRow("SELECT COUNT(*) FROM webhook_delivery WHERE webhook_id = $1", webhookID).Scan(&deliveries)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if deliveries == 2 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("delivery log has %d rows, want 2", deliveries)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    webhooks.Close()
+
+    deliveries, err := getWebhookDeliveries(db, webhookID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // newest first
+    if deliveries[0].Attempt != 2 || !deliveries[0].Succeeded || deliveries[0].StatusCode != 200 {
+        t.Errorf("second attempt logged as %+v", deliveries[0])
+    }
+    if deliveries[1].Attempt != 1 || deliveries[1].Succeeded || deliveries[1].StatusCode != 503 || deliveries[1].Event != webhook.StoryUpdated {
+        t.Errorf("first attempt logged as %+v", deliveries[1])
+    }
+}
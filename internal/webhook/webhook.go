@@ -0,0 +1,286 @@
+package webhook
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+const (
+    StoryPublished = "story.published"
+    StoryUpdated = "story.updated"
+    StoryCancelled = "story.cancelled"
+    TaskCreated = "task.created"
+    TaskUpdated = "task.updated"
+    TaskDeleted = "task.deleted"
+    AssignmentJoined = "assignment.joined"
+    AssignmentLeft = "assignment.left"
+    Ping = "ping"
+)
+
+const (
+    SignatureHeader = "X-Webhook-Signature"
+    EventHeader = "X-Webhook-Event"
+    DeliveryHeader = "X-Webhook-Delivery"
+)
+
+// Payload is the JSON body every webhook receives.
+type Payload struct {
+    ID string `json:"id"`
+    Event string `json:"event"`
+    StoryID int64 `json:"story_id"`
+    OccurredAt time.Time `json:"occurred_at"`
+    Data any `json:"data"`
+}
+
+type Target struct {
+    WebhookID int64
+    URL string
+    Secret string
+}
+
+// Attempt describes a single delivery attempt of a payload to a target.
+type Attempt struct {
+    WebhookID int64
+    DeliveryID string
+    Event string
+    Body []byte
+    Number int
+    StatusCode int
+    Err error
+    Time time.Time
+}
+
+func (a Attempt) Succeeded() bool {
+    return a.Err == nil && a.StatusCode >= 200 && a.StatusCode < 300
+}
+
+// Sign returns the value of the signature header for the body, the hex
+// encoded HMAC-SHA256 of the raw body keyed with the webhook secret.
+func Sign(secret string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func NewPayload(event string, storyID int64, data any) Payload {
+    return Payload{
+        ID: uuid.New().String(),
+        Event: event,
+        StoryID: storyID,
+        OccurredAt: time.Now().UTC(),
+        Data: data,
+    }
+}
+
+// ErrPrivateAddress is returned for targets on loopback, private, link-local
+// and other non-public addresses, so webhooks cannot reach services on the
+// network of the server.
+var ErrPrivateAddress = errors.New("Webhook target is not a public address")
+
+// reservedNetworks are not public but not covered by the checks of net.IP.
+var reservedNetworks = []string{
+    "0.0.0.0/8",
+    "100.64.0.0/10",
+    "192.0.0.0/24",
+    "198.18.0.0/15",
+    "240.0.0.0/4",
+    "64:ff9b::/96",
+}
+
+// IsPublicAddress reports whether a webhook may connect to the address.
+func IsPublicAddress(ip net.IP) bool {
+    if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+        ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+        return false
+    }
+    for _, cidr := range reservedNetworks {
+        _, network, err := net.ParseCIDR(cidr)
+        if err == nil && network.Contains(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+// CheckURL refuses targets that are obviously not public, like localhost or a
+// private IP address, when the webhook is created. Host names can still
+// resolve to anything, the client returned by PublicClient checks those.
+func CheckURL(target *url.URL) error {
+    host := strings.ToLower(target.Hostname())
+    if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+        return ErrPrivateAddress
+    }
+    ip := net.ParseIP(host)
+    if ip != nil && !IsPublicAddress(ip) {
+        return ErrPrivateAddress
+    }
+    return nil
+}
+
+// refusePrivate runs right before a connection is made, with the resolved
+// address, so host names pointing to internal addresses are refused as well.
+func refusePrivate(network string, address string, conn syscall.RawConn) error {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    ip := net.ParseIP(host)
+    if ip == nil || !IsPublicAddress(ip) {
+        return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+    }
+    return nil
+}
+
+// PublicClient returns a client that only connects to public addresses, for
+// every connection including redirects, and ignores proxy settings.
+func PublicClient(timeout time.Duration) *http.Client {
+    dialer := &net.Dialer{ Timeout: timeout, Control: refusePrivate }
+    return &http.Client{
+        Timeout: timeout,
+        Transport: &http.Transport{
+            DialContext: dialer.DialContext,
+            TLSHandshakeTimeout: timeout,
+            MaxIdleConns: 10,
+            IdleConnTimeout: 90 * time.Second,
+        },
+    }
+}
+
+// Dispatcher delivers payloads in the background, retrying failed attempts
+// with exponential backoff. Every attempt is passed to the record function.
+type Dispatcher struct {
+    Client *http.Client
+    MaxAttempts int
+    Backoff time.Duration
+    record func(Attempt)
+    stop chan struct{}
+    mu sync.Mutex
+    closed bool
+    wg sync.WaitGroup
+}
+
+func NewDispatcher(record func(Attempt)) *Dispatcher {
+    return &Dispatcher{
+        Client: PublicClient(10 * time.Second),
+        MaxAttempts: 5,
+        Backoff: 2 * time.Second,
+        record: record,
+        stop: make(chan struct{}),
+    }
+}
+
+// Dispatch queues the payload for the target and returns right away.
+func (d *Dispatcher) Dispatch(target Target, payload Payload) error {
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.closed {
+        return fmt.Errorf("Webhook dispatcher is closed")
+    }
+    d.wg.Add(1)
+    go d.deliver(target, payload, body)
+    return nil
+}
+
+func (d *Dispatcher) deliver(target Target, payload Payload, body []byte) {
+    defer d.wg.Done()
+    backoff := d.Backoff
+    for number := 1; number <= d.MaxAttempts; number++ {
+        attempt := d.send(target, payload, body, number)
+        if attempt.Succeeded() {
+            return
+        }
+        if number == d.MaxAttempts {
+            return
+        }
+        select {
+        case <-d.stop:
+            return
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+    }
+}
+
+// Send makes one attempt right away, without retries.
+func (d *Dispatcher) Send(target Target, payload Payload) Attempt {
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return Attempt{ WebhookID: target.WebhookID, DeliveryID: payload.ID, Event: payload.Event, Number: 1, Err: err, Time: time.Now() }
+    }
+    return d.send(target, payload, body, 1)
+}
+
+func (d *Dispatcher) send(target Target, payload Payload, body []byte, number int) Attempt {
+    attempt := Attempt{
+        WebhookID: target.WebhookID,
+        DeliveryID: payload.ID,
+        Event: payload.Event,
+        Body: body,
+        Number: number,
+        Time: time.Now(),
+    }
+    request, err := http.NewRequest("POST", target.URL, bytes.NewReader(body))
+    if err != nil {
+        attempt.Err = err
+        d.record(attempt)
+        return attempt
+    }
+    request.Header.Set("Content-Type", "application/json")
+    request.Header.Set("User-Agent", "sk-webhook")
+    request.Header.Set(SignatureHeader, Sign(target.Secret, body))
+    request.Header.Set(EventHeader, payload.Event)
+    request.Header.Set(DeliveryHeader, payload.ID)
+
+    response, err := d.Client.Do(request)
+    if err != nil {
+        attempt.Err = err
+        d.record(attempt)
+        return attempt
+    }
+    io.Copy(io.Discard, io.LimitReader(response.Body, 64 * 1024))
+    response.Body.Close()
+    attempt.StatusCode = response.StatusCode
+    if !attempt.Succeeded() {
+        attempt.Err = fmt.Errorf("Receiver responded with %s", response.Status)
+    }
+    d.record(attempt)
+    return attempt
+}
+
+// Running reports whether the dispatcher still accepts payloads.
+func (d *Dispatcher) Running() bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return !d.closed
+}
+
+// Close stops accepting payloads, cancels pending retries and waits for
+// the attempts that are in flight.
+func (d *Dispatcher) Close() {
+    d.mu.Lock()
+    if !d.closed {
+        d.closed = true
+        close(d.stop)
+    }
+    d.mu.Unlock()
+    d.wg.Wait()
+}
@@ -0,0 +1,136 @@
+package webhook
+
+import (
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestPublicClientRefusesLoopback(t *testing.T) {
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        t.Error("request reached the loopback receiver")
+    }))
+    defer receiver.Close()
+
+    _, err := PublicClient(time.Second).Post(receiver.URL, "application/json", nil)
+    if !errors.Is(err, ErrPrivateAddress) {
+        t.Errorf("got error %v, want ErrPrivateAddress", err)
+    }
+}
+
+func TestIsPublicAddress(t *testing.T) {
+    for address, public := range map[string]bool{
+        "93.184.216.34": true,
+        "2606:4700::1111": true,
+        "127.0.0.1": false,
+        "10.1.2.3": false,
+        "172.16.0.1": false,
+        "192.168.1.1": false,
+        "169.254.169.254": false,
+        "100.64.0.1": false,
+        "0.0.0.0": false,
+        "::1": false,
+        "fe80::1": false,
+        "fd00::1": false,
+        "::ffff:127.0.0.1": false,
+    } {
+        if IsPublicAddress(net.ParseIP(address)) != public {
+            t.Errorf("IsPublicAddress(%s) = %v, want %v", address, !public, public)
+        }
+    }
+}
+
+func TestCheckURL(t *testing.T) {
+    for target, allowed := range map[string]bool{
+        "https://example.com/hook": true,
+        "http://localhost:8080/hook": false,
+        "http://api.localhost/hook": false,
+        "http://127.0.0.1/hook": false,
+        "http://[::1]/hook": false,
+        "http://169.254.169.254/latest/meta-data": false,
+    } {
+        parsed, err := url.Parse(target)
+        if err != nil {
+            t.Fatal(err)
+        }
+        err = CheckURL(parsed)
+        if (err == nil) != allowed {
+            t.Errorf("CheckURL(%s) = %v, want allowed %v", target, err, allowed)
+        }
+    }
+}
+
+// TestDispatchRetries delivers to a local receiver that fails twice, the
+// loopback check is left out by using a plain client.
+func TestDispatchRetries(t *testing.T) {
+    const secret = "secret"
+    var mu sync.Mutex
+    requests := 0
+    delivered := make(chan struct{})
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        if r.Header.Get(SignatureHeader) != Sign(secret, body) {
+            t.Errorf("signature %s does not match the body", r.Header.Get(SignatureHeader))
+        }
+        if r.Header.Get(EventHeader) != TaskCreated || r.Header.Get(DeliveryHeader) == "" {
+            t.Errorf("unexpected headers %v", r.Header)
+        }
+        mu.Lock()
+        defer mu.Unlock()
+        requests++
+        if requests < 3 {
+            w.WriteHeader(500)
+            return
+        }
+        close(delivered)
+    }))
+    defer receiver.Close()
+
+    attempts := []Attempt{}
+    dispatcher := NewDispatcher(func(attempt Attempt) {
+        mu.Lock()
+        defer mu.Unlock()
+        attempts = append(attempts, attempt)
+    })
+    dispatcher.Client = &http.Client{ Timeout: time.Second }
+    dispatcher.Backoff = 20 * time.Millisecond
+
+    payload := NewPayload(TaskCreated, 1, map[string]string{ "name": "Task" })
+    err := dispatcher.Dispatch(Target{ WebhookID: 7, URL: receiver.URL, Secret: secret }, payload)
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-delivered:
+    case <-time.After(5 * time.Second):
+        t.Fatal("payload was not delivered")
+    }
+    dispatcher.Close()
+
+    mu.Lock()
+    defer mu.Unlock()
+    if len(attempts) != 3 {
+        t.Fatalf("recorded %d attempts, want 3", len(attempts))
+    }
+    for i, attempt := range attempts {
+        if attempt.Number != i + 1 || attempt.WebhookID != 7 || attempt.DeliveryID != payload.ID {
+            t.Errorf("attempt %d recorded as %+v", i + 1, attempt)
+        }
+        if attempt.Succeeded() != (i == 2) {
+            t.Errorf("attempt %d succeeded: %v", i + 1, attempt.Succeeded())
+        }
+    }
+    // the wait doubles after every failed attempt
+    if gap := attempts[1].Time.Sub(attempts[0].Time); gap < dispatcher.Backoff {
+        t.Errorf("second attempt came after %s, want at least %s", gap, dispatcher.Backoff)
+    }
+    if gap := attempts[2].Time.Sub(attempts[1].Time); gap < 2 * dispatcher.Backoff {
+        t.Errorf("third attempt came after %s, want at least %s", gap, 2 * dispatcher.Backoff)
+    }
+}
@@ -1,50 +1,264 @@
-package main
-
-import (
-    "log"
-    "net/http"
-
-    "github.com/joho/godotenv"
-    "github.com/gorilla/mux"
-    _ "modernc.org/sqlite"
-
-    "zmtwc/sk/internal/server"
-)
-
-func main() {
-    err := godotenv.Load(".env")
-    if err != nil {
-        log.Fatal("Cannot load environment variables")
-    }
-
-    r := mux.NewRouter()
-    r.HandleFunc("/", server.LandingPage).Methods("GET")
-    r.HandleFunc("/login", server.LoginPageHandler).Methods("GET")
-    r.HandleFunc("/register", server.RegisterPageHandler).Methods("GET")
-
-    r.HandleFunc("/view/header", server.HeaderHandler).Methods("GET")
-    r.HandleFunc("/view/story", server.StoryListHandler).Methods("GET")
-    r.HandleFunc("/view/story/{id}/edit", server.StoryEditPageHandler).Methods("GET")
-    r.HandleFunc("/view/task/{id}/edit", server.ChangeStoryTaskViewHandler).Methods("GET")
-    r.HandleFunc("/view/create_story", server.CreateStoryPage).Methods("GET")
-
-    r.HandleFunc("/login", server.DoLoginHandler).Methods("POST")
-    r.HandleFunc("/register", server.DoRegisterHandler).Methods("POST")
-    r.HandleFunc("/logout", server.DoLogoutHandler).Methods("POST")
-
-    r.HandleFunc("/story/{id}/finalize/task", server.AddTaskToStoryFinalizeHandler).Methods("POST")
-    r.HandleFunc("/story/{id}/task", server.AddTaskToStoryHandler).Methods("POST")
-    r.HandleFunc("/task/{id}", server.DeleteStoryTaskHandler).Methods("DELETE")
-    r.HandleFunc("/task/{id}", server.TaskDetailHandler).Methods("GET")
-    r.HandleFunc("/task/{id}", server.ChangeTaskHandler).Methods("PUT")
-    r.HandleFunc("/task/{id}/assignment", server.ChangeStoryTaskAssignmentHandler).Methods("PUT")
-    r.HandleFunc("/story/{id}/finalize", server.FinalizeCreateStoryHandler).Methods("PUT")
-    r.HandleFunc("/story/{id}", server.ChangeStoryHandler).Methods("PUT")
-    r.HandleFunc("/story/{id}", server.DeleteStoryHandler).Methods("DELETE")
-    r.HandleFunc("/story/{id}", server.StoryDetailHandler).Methods("GET")
-
-    http.Handle("/", r)
-
-    log.Printf("Starting server")
-    log.Fatal(http.ListenAndServe("127.0.0.1:8000", nil))
-}
+package main
+
+import (
+    "context"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
+    "log/slog"
+    "net/http"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+
+    "github.com/gorilla/mux"
+    _ "modernc.org/sqlite"
+
+    "zmtwc/sk/internal/config"
+    "zmtwc/sk/internal/logging"
+    "zmtwc/sk/internal/notify"
+    "zmtwc/sk/internal/scheduler"
+    "zmtwc/sk/internal/server"
+)
+
+// checkSchema stops the server from starting on a database that lacks
+// columns it needs, the operator has to run the migrations first.
+func checkSchema() error {
+    db, err := server.OpenDB()
+    if err != nil {
+        return err
+    }
+    pending, err := server.PendingMigrations(db)
+    if err != nil {
+        return fmt.Errorf("Cannot check database schema: %s, run sk migrate", err)
+    }
+    if pending > 0 {
+        return fmt.Errorf("Database needs %d migrations, run sk migrate", pending)
+    }
+    return nil
+}
+
+func newRouter() *mux.Router {
+    r := mux.NewRouter()
+    r.Use(logging.RouteMiddleware)
+    r.HandleFunc("/healthz", server.HealthzHandler).Methods("GET", "HEAD")
+    r.HandleFunc("/readyz", server.ReadyzHandler).Methods("GET", "HEAD")
+    r.HandleFunc("/", server.LandingPage).Methods("GET")
+    r.HandleFunc("/login", server.LoginPageHandler).Methods("GET")
+    r.HandleFunc("/register", server.RegisterPageHandler).Methods("GET")
+    r.HandleFunc("/invite/{token}", server.InviteLinkHandler).Methods("GET")
+
+    r.HandleFunc("/view/header", server.HeaderHandler).Methods("GET")
+    r.HandleFunc("/view/story", server.StoryListHandler).Methods("GET")
+    r.HandleFunc("/view/story/{id}/edit", server.StoryEditPageHandler).Methods("GET")
+    r.HandleFunc("/view/story/{id}/sharing", server.StorySharingHandler).Methods("GET")
+    r.HandleFunc("/view/story/{id}/organizers", server.StoryOrganizersHandler).Methods("GET")
+    r.HandleFunc("/view/story/{id}/checkin", server.StoryCheckInHandler).Methods("GET")
+    r.HandleFunc("/view/story/{id}/webhooks", server.StoryWebhooksHandler).Methods("GET")
+    r.HandleFunc("/view/story/{id}/comments", server.CommentThreadHandler).Methods("GET")
+    r.HandleFunc("/view/comment/{id}/edit", server.CommentEditViewHandler).Methods("GET")
+    r.HandleFunc("/view/task/{id}/edit", server.ChangeStoryTaskViewHandler).Methods("GET")
+    r.HandleFunc("/view/create_story", server.CreateStoryPage).Methods("GET")
+    r.HandleFunc("/view/calendar", server.CalendarPageHandler).Methods("GET")
+    r.HandleFunc("/view/notifications", server.NotificationSettingsHandler).Methods("GET")
+    r.HandleFunc("/view/inbox", server.InboxHandler).Methods("GET")
+    r.HandleFunc("/view/inbox/badge", server.InboxBadgeHandler).Methods("GET")
+    r.HandleFunc("/calendar/{token}", server.CalendarFeedHandler).Methods("GET")
+
+    r.HandleFunc("/login", server.DoLoginHandler).Methods("POST")
+    r.HandleFunc("/register", server.DoRegisterHandler).Methods("POST")
+    r.HandleFunc("/logout", server.DoLogoutHandler).Methods("POST")
+    r.HandleFunc("/invite", server.RedeemInviteCodeHandler).Methods("POST")
+    r.HandleFunc("/calendar/token", server.ResetCalendarTokenHandler).Methods("POST")
+    r.HandleFunc("/notifications", server.ChangeNotificationSettingsHandler).Methods("PUT")
+    r.HandleFunc("/inbox/read", server.MarkAllNotificationsReadHandler).Methods("PUT")
+    r.HandleFunc("/inbox/{id}/read", server.MarkNotificationReadHandler).Methods("PUT")
+
+    r.HandleFunc("/story/{id}/finalize/task", server.AddTaskToStoryFinalizeHandler).Methods("POST")
+    r.HandleFunc("/story/{id}/finalize/import", server.ImportTasksFinalizeHandler).Methods("POST")
+    r.HandleFunc("/story/{id}/task", server.AddTaskToStoryHandler).Methods("POST")
+    r.HandleFunc("/story/{id}/invite", server.CreateInviteLinkHandler).Methods("POST")
+    r.HandleFunc("/story/{id}/invite/{linkID}", server.RevokeInviteLinkHandler).Methods("DELETE")
+    r.HandleFunc("/story/{id}/invitee", server.AddStoryInviteeHandler).Methods("POST")
+    r.HandleFunc("/story/{id}/invitee/{userID}", server.RemoveStoryInviteeHandler).Methods("DELETE")
+    r.HandleFunc("/story/{id}/organizer", server.AddStoryOrganizerHandler).Methods("POST")
+    r.HandleFunc("/story/{id}/organizer/{userID}", server.RemoveStoryOrganizerHandler).Methods("DELETE")
+    r.HandleFunc("/story/{id}/owner", server.TransferStoryOwnershipHandler).Methods("PUT")
+    r.HandleFunc("/story/{id}/tasks", server.StoryTasksJSONHandler).Methods("GET")
+    r.HandleFunc("/story/{id}/events", server.StoryEventsHandler).Methods("GET")
+    r.HandleFunc("/story/{id}/calendar.ics", server.StoryCalendarHandler).Methods("GET")
+    r.HandleFunc("/story/{id}/export.csv", server.StoryExportHandler).Methods("GET")
+    r.HandleFunc("/story/{id}/tasks/order", server.ReorderStoryTasksHandler).Methods("PUT")
+    r.HandleFunc("/story/{id}/comment", server.CreateCommentHandler).Methods("POST")
+    r.HandleFunc("/story/{id}/webhook", server.CreateWebhookHandler).Methods("POST")
+    r.HandleFunc("/webhook/{id}", server.DeleteWebhookHandler).Methods("DELETE")
+    r.HandleFunc("/webhook/{id}/test", server.TestWebhookHandler).Methods("POST")
+    r.HandleFunc("/comment/{id}", server.CommentHandler).Methods("GET")
+    r.HandleFunc("/comment/{id}", server.ChangeCommentHandler).Methods("PUT")
+    r.HandleFunc("/comment/{id}", server.DeleteCommentHandler).Methods("DELETE")
+    r.HandleFunc("/task/{id}", server.DeleteStoryTaskHandler).Methods("DELETE")
+    r.HandleFunc("/task/{id}", server.TaskDetailHandler).Methods("GET")
+    r.HandleFunc("/task/{id}/calendar.ics", server.TaskCalendarHandler).Methods("GET")
+    r.HandleFunc("/task/{id}", server.ChangeTaskHandler).Methods("PUT")
+    r.HandleFunc("/task/{id}/assignment", server.ChangeStoryTaskAssignmentHandler).Methods("PUT")
+    r.HandleFunc("/task/{id}/assignee", server.AssignTaskUserHandler).Methods("POST")
+    r.HandleFunc("/task/{id}/lock", server.ChangeTaskLockHandler).Methods("PUT")
+    r.HandleFunc("/assignment/{id}", server.RemoveAssignmentHandler).Methods("DELETE")
+    r.HandleFunc("/assignment/{id}/task", server.MoveAssignmentHandler).Methods("PUT")
+    r.HandleFunc("/assignment/{id}/attendance", server.ChangeAttendanceHandler).Methods("PUT")
+    r.HandleFunc("/story/{id}/finalize", server.FinalizeCreateStoryHandler).Methods("PUT")
+    r.HandleFunc("/story/{id}", server.ChangeStoryHandler).Methods("PUT")
+    r.HandleFunc("/story/{id}", server.DeleteStoryHandler).Methods("DELETE")
+    r.HandleFunc("/story/{id}", server.StoryDetailHandler).Methods("GET")
+    return r
+}
+
+// serve runs the server until SIGINT or SIGTERM, then lets requests in flight
+// finish, ends live update streams and stops the background workers, so
+// nothing they have queued is lost.
+func serve(cfg config.Config) error {
+    err := checkSchema()
+    if err != nil {
+        return err
+    }
+    mailer, err := notify.NewMailer(cfg.Mail)
+    if err != nil {
+        return fmt.Errorf("Cannot configure mailer: %s", err)
+    }
+    var mailQueue *notify.Queue
+    if mailer != nil {
+        mailQueue = server.StartNotifications(mailer)
+    }
+    reminders := server.StartReminders(scheduler.SystemClock{})
+    backups := server.StartBackups(scheduler.SystemClock{})
+
+    router := newRouter()
+    if cfg.MetricsListenAddr == "" && cfg.MetricsToken != "" {
+        router.Handle("/metrics", server.MetricsHandler()).Methods("GET")
+    }
+    httpServer := &http.Server{
+        Addr: cfg.ListenAddr,
+        Handler: logging.Middleware(router, server.ObserveRequest),
+        ReadHeaderTimeout: cfg.ReadTimeout,
+        ReadTimeout: cfg.ReadTimeout,
+        WriteTimeout: cfg.WriteTimeout,
+        IdleTimeout: cfg.IdleTimeout,
+        ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+    }
+    httpServer.RegisterOnShutdown(server.StopLiveUpdates)
+
+    stopped := make(chan error, 2)
+    go func() {
+        if cfg.TLSCertFile != "" {
+            stopped <- httpServer.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+        } else {
+            stopped <- httpServer.ListenAndServe()
+        }
+    }()
+    slog.Info("Starting server", "address", cfg.ListenAddr, "tls", cfg.TLSCertFile != "")
+
+    // the metrics listener is meant for the internal network of the monitoring
+    var metricsServer *http.Server
+    if cfg.MetricsListenAddr != "" {
+        metricsRouter := http.NewServeMux()
+        metricsRouter.Handle("/metrics", server.MetricsHandler())
+        metricsServer = &http.Server{
+            Addr: cfg.MetricsListenAddr,
+            Handler: metricsRouter,
+            ReadHeaderTimeout: cfg.ReadTimeout,
+            ReadTimeout: cfg.ReadTimeout,
+            WriteTimeout: cfg.WriteTimeout,
+            IdleTimeout: cfg.IdleTimeout,
+            ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+        }
+        go func() {
+            stopped <- metricsServer.ListenAndServe()
+        }()
+        slog.Info("Serving metrics", "address", cfg.MetricsListenAddr)
+    }
+
+    signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stopSignals()
+    select {
+    case err = <-stopped:
+    case <-signals.Done():
+        // a second signal ends the process right away
+        stopSignals()
+        server.SetShuttingDown()
+        if cfg.DrainDelay > 0 {
+            slog.Info("Reporting not ready before draining", "delay", cfg.DrainDelay)
+            time.Sleep(cfg.DrainDelay)
+        }
+        slog.Info("Shutting down, waiting for requests to finish", "timeout", cfg.ShutdownTimeout)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+    defer cancel()
+    shutdownErr := httpServer.Shutdown(ctx)
+    if metricsServer != nil {
+        metricsServer.Shutdown(ctx)
+    }
+    if err == nil || errors.Is(err, http.ErrServerClosed) {
+        err = shutdownErr
+    }
+
+    reminders.Stop()
+    if backups != nil {
+        backups.Stop()
+    }
+    if mailQueue != nil {
+        mailQueue.Close()
+    }
+    server.StopWebhooks()
+    slog.Info("Server stopped")
+    return err
+}
+
+// fatal logs the error and exits, for errors that happen once the logger is set up.
+func fatal(message string, err error) {
+    slog.Error(message, "error", err)
+    os.Exit(1)
+}
+
+func main() {
+    cfg, args, err := config.Load(os.Args[1:])
+    if errors.Is(err, flag.ErrHelp) {
+        fmt.Fprintln(os.Stderr, usage)
+        return
+    }
+    if err != nil {
+        log.Fatal(err)
+    }
+    logger, err := logging.New(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+    if err != nil {
+        log.Fatal(err)
+    }
+    slog.SetDefault(logger)
+    server.Configure(cfg)
+    err = server.LoadTemplates()
+    if err != nil {
+        fatal("Cannot load templates", err)
+    }
+    err = server.OpenPool()
+    if err != nil {
+        fatal("Cannot open database", err)
+    }
+
+    if len(args) > 0 && args[0] != "serve" {
+        err = runCommand(args[0], args[1:])
+    } else {
+        for _, setting := range strings.Split(cfg.Redacted(), "\n") {
+            slog.Info("Configuration", "setting", setting)
+        }
+        err = serve(cfg)
+    }
+    closeErr := server.ClosePool()
+    if err != nil {
+        fatal("Stopped with an error", err)
+    }
+    if closeErr != nil {
+        fatal("Error closing database", closeErr)
+    }
+}